@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/utilitywarehouse/vault-kube-cloud-credentials/operator"
 	"github.com/utilitywarehouse/vault-kube-cloud-credentials/sidecar"
@@ -15,7 +17,16 @@ import (
 var (
 	operatorCommand        = flag.NewFlagSet("operator", flag.ExitOnError)
 	flagOperatorConfigFile = operatorCommand.String("config-file", "", "Path to a configuration file")
-	flagOperatorProvider   = operatorCommand.String("provider", "aws", "Cloud provider (one of 'aws' or 'gcp')")
+	flagOperatorProvider   = operatorCommand.String("provider", "", "Comma separated list of cloud providers (any of 'aws', 'gcp' or 'azure'). Overrides the providers in the config file (default: aws)")
+	flagOperatorDryRun     = operatorCommand.Bool("dry-run", false, "Report the changes that would be made to vault without making them")
+	flagOperatorDryRunJSON = operatorCommand.Bool("dry-run-json", false, "In dry-run mode, also write the changes to stdout as lines of JSON")
+
+	checkCommand            = flag.NewFlagSet("check", flag.ExitOnError)
+	flagCheckConfigFile     = checkCommand.String("config-file", "", "Path to a configuration file")
+	flagCheckProvider       = checkCommand.String("provider", "", "Comma separated list of cloud providers (any of 'aws', 'gcp' or 'azure'). Overrides the providers in the config file (default: aws)")
+	flagCheckNamespace      = checkCommand.String("namespace", "", "Namespace to check the identity for, instead of reading manifests")
+	flagCheckServiceAccount = checkCommand.String("service-account", "default", "Name of the service account to check the identity for")
+	flagCheckIdentity       = checkCommand.String("identity", "", "Role arn, service account email or azure identity to check for the namespace. Requires a single -provider")
 
 	sidecarCommand                = flag.NewFlagSet("sidecar", flag.ExitOnError)
 	flagSidecarKubeTokenPath      = sidecarCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token")
@@ -24,6 +35,8 @@ var (
 	flagSidecarVaultRole          = sidecarCommand.String("vault-role", "", "Must be in the format: `<prefix>_<provider>_<namespace>_<service-account>`")
 	flagSidecarVaultStaticAccount = sidecarCommand.String("vault-static-account", "", "Must be in the format: `<prefix>_<provider>_<namespace>_<service-account>`")
 	flagSidecarSecretType         = sidecarCommand.String("secret-type", "access_token", "Secret type (one of 'service_account_key' or 'access_token')")
+	flagSidecarAzureTenantID      = sidecarCommand.String("azure-tenant-id", os.Getenv("AZURE_TENANT_ID"), "Azure tenant that access tokens are requested from, defaults to the value of AZURE_TENANT_ID")
+	flagSidecarVaultNamespace     = sidecarCommand.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault namespace to login to and read credentials from, defaults to the value of VAULT_NAMESPACE")
 
 	log = ctrl.Log.WithName("main")
 
@@ -31,7 +44,7 @@ var (
 	//
 	// 0: exp-1_aws_sys-prom_thanos-compact
 	// 1: prefix (Vault instance) example values: "exp-1", "dev", "prod"
-	// 2: provider (AWS|GCP)
+	// 2: provider (AWS|GCP|Azure)
 	// 3: kubernetes_namespace
 	// 4: kubernetes_service_account
 	vaultRoleRegex = regexp.MustCompile(`([-\w]+)_([-\w]+)_([-\w]+)_([-\w]+)`)
@@ -44,6 +57,7 @@ func usage() {
 
 Commands:
   operator      Run the operator
+  check         Check service accounts against the operator rules
   sidecar       Sidecar for provider credentials
 `, os.Args[0])
 }
@@ -63,6 +77,8 @@ func main() {
 	case "operator":
 		logOpts.BindFlags(operatorCommand)
 		operatorCommand.Parse(os.Args[2:])
+	case "check":
+		checkCommand.Parse(os.Args[2:])
 	case "sidecar":
 		logOpts.BindFlags(sidecarCommand)
 		sidecarCommand.Parse(os.Args[2:])
@@ -79,7 +95,19 @@ func main() {
 			os.Exit(1)
 		}
 
-		o, err := operator.New(*flagOperatorConfigFile, *flagOperatorProvider)
+		var providers []string
+		if *flagOperatorProvider != "" {
+			for _, p := range strings.Split(*flagOperatorProvider, ",") {
+				providers = append(providers, strings.TrimSpace(p))
+			}
+		}
+
+		var dryRunOutput io.Writer
+		if *flagOperatorDryRunJSON {
+			dryRunOutput = os.Stdout
+		}
+
+		o, err := operator.New(*flagOperatorConfigFile, providers, *flagOperatorDryRun, dryRunOutput)
 		if err != nil {
 			log.Error(err, "error creating operator")
 			os.Exit(1)
@@ -93,6 +121,64 @@ func main() {
 		return
 	}
 
+	if checkCommand.Parsed() {
+		var providers []string
+		if *flagCheckProvider != "" {
+			for _, p := range strings.Split(*flagCheckProvider, ",") {
+				providers = append(providers, strings.TrimSpace(p))
+			}
+		}
+
+		manifests := &operator.Manifests{}
+		if *flagCheckNamespace != "" || *flagCheckIdentity != "" {
+			if *flagCheckNamespace == "" || *flagCheckIdentity == "" || len(providers) != 1 {
+				log.Error(nil, "'namespace', 'identity' and a single 'provider' must be specified together.")
+				os.Exit(1)
+			}
+			sa, err := operator.NewCheckServiceAccount(providers[0], *flagCheckNamespace, *flagCheckServiceAccount, *flagCheckIdentity)
+			if err != nil {
+				log.Error(err, "error creating service account")
+				os.Exit(1)
+			}
+			manifests.ServiceAccounts = append(manifests.ServiceAccounts, sa)
+		}
+
+		// Manifests are read from the file arguments, where '-' is stdin
+		for _, file := range checkCommand.Args() {
+			r := os.Stdin
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					log.Error(err, "error opening manifest", "file", file)
+					os.Exit(1)
+				}
+				defer f.Close()
+				r = f
+			}
+			if err := manifests.Read(r); err != nil {
+				log.Error(err, "error reading manifest", "file", file)
+				os.Exit(1)
+			}
+		}
+
+		results, err := operator.Check(*flagCheckConfigFile, providers, manifests)
+		if err != nil {
+			log.Error(err, "error checking service accounts")
+			os.Exit(1)
+		}
+
+		ok := true
+		for _, r := range results {
+			fmt.Println(r.String())
+			ok = ok && r.OK()
+		}
+		if !ok {
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	if sidecarCommand.Parsed() {
 		if len(sidecarCommand.Args()) > 0 {
 			sidecarCommand.PrintDefaults()
@@ -135,6 +221,18 @@ func main() {
 				KeyFileDestinationPath: keyFilePath,
 			}
 			kubeAuthRole = *flagSidecarVaultStaticAccount
+		case "azure":
+			if *flagSidecarAzureTenantID == "" {
+				log.Error(nil, "'azure-tenant-id' must be specified for the azure provider.")
+				os.Exit(1)
+			}
+
+			pc = &sidecar.AzureProviderConfig{
+				Path:     "azure",
+				Role:     *flagSidecarVaultRole,
+				TenantID: *flagSidecarAzureTenantID,
+			}
+			kubeAuthRole = *flagSidecarVaultRole
 		default:
 			usage()
 			return
@@ -147,6 +245,7 @@ func main() {
 			OpsAddress:     *flagSidecarOpsAddr,
 			ProviderConfig: pc,
 			TokenPath:      *flagSidecarKubeTokenPath,
+			VaultNamespace: *flagSidecarVaultNamespace,
 		}
 
 		s, err := sidecar.New(sidecarConfig)
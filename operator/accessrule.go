@@ -0,0 +1,322 @@
+package operator
+
+import (
+	"context"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group and version of the access rule resources
+	GroupVersion = schema.GroupVersion{Group: "vault.uw.systems", Version: "v1alpha1"}
+
+	// SchemeBuilder registers the access rule resources with a scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the access rule resources to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(
+		&AWSAccessRule{}, &AWSAccessRuleList{},
+		&GCPAccessRule{}, &GCPAccessRuleList{},
+		&AzureAccessRule{}, &AzureAccessRuleList{},
+	)
+}
+
+// AWSAccessRule is a cluster scoped resource that holds an AWSRule. Access
+// rule resources are evaluated after the rules in the config file.
+type AWSAccessRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AWSRule `json:"spec"`
+}
+
+// AWSAccessRuleList is a list of AWSAccessRules
+type AWSAccessRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []AWSAccessRule `json:"items"`
+}
+
+// GCPAccessRule is a cluster scoped resource that holds a GCPRule. Access
+// rule resources are evaluated after the rules in the config file.
+type GCPAccessRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GCPRule `json:"spec"`
+}
+
+// GCPAccessRuleList is a list of GCPAccessRules
+type GCPAccessRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []GCPAccessRule `json:"items"`
+}
+
+// AzureAccessRule is a cluster scoped resource that holds an AzureRule.
+// Access rule resources are evaluated after the rules in the config file.
+type AzureAccessRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AzureRule `json:"spec"`
+}
+
+// AzureAccessRuleList is a list of AzureAccessRules
+type AzureAccessRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []AzureAccessRule `json:"items"`
+}
+
+// loadAccessRules lists the AWSAccessRules in the cluster and replaces the
+// rules from resources with them, ordered by name
+func (a *AWS) loadAccessRules(ctx context.Context, c client.Reader) error {
+	list := &AWSAccessRuleList{}
+	if err := c.List(ctx, list); err != nil {
+		return err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	rules := make(AWSRules, 0, len(list.Items))
+	for _, r := range list.Items {
+		// The policy template of a rule can grant anything in vault,
+		// so it can only be set in the config file rather than by
+		// anyone who can create access rules
+		if r.Spec.PolicyTemplate != "" {
+			log.Info("ignoring the policyTemplate of access rule, policy templates can only be set in the config file", "kind", "AWSAccessRule", "name", r.Name)
+			r.Spec.PolicyTemplate = ""
+		}
+		// An invalid rule would fail the evaluation of the rules after
+		// it, so it's left out instead
+		if err := r.Spec.validate(); err != nil {
+			log.Error(err, "ignoring invalid access rule", "kind", "AWSAccessRule", "name", r.Name)
+			continue
+		}
+		rules = append(rules, r.Spec)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resourceRules = rules
+
+	return nil
+}
+
+func (a *AWS) accessRule() client.Object {
+	return &AWSAccessRule{}
+}
+
+// loadAccessRules lists the GCPAccessRules in the cluster and replaces the
+// rules from resources with them, ordered by name
+func (g *GCP) loadAccessRules(ctx context.Context, c client.Reader) error {
+	list := &GCPAccessRuleList{}
+	if err := c.List(ctx, list); err != nil {
+		return err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	rules := make(GCPRules, 0, len(list.Items))
+	for _, r := range list.Items {
+		// The policy template of a rule can grant anything in vault,
+		// so it can only be set in the config file rather than by
+		// anyone who can create access rules
+		if r.Spec.PolicyTemplate != "" {
+			log.Info("ignoring the policyTemplate of access rule, policy templates can only be set in the config file", "kind", "GCPAccessRule", "name", r.Name)
+			r.Spec.PolicyTemplate = ""
+		}
+		// An invalid rule would fail the evaluation of the rules after
+		// it, so it's left out instead
+		if err := r.Spec.validate(); err != nil {
+			log.Error(err, "ignoring invalid access rule", "kind", "GCPAccessRule", "name", r.Name)
+			continue
+		}
+		rules = append(rules, r.Spec)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.resourceRules = rules
+
+	return nil
+}
+
+func (g *GCP) accessRule() client.Object {
+	return &GCPAccessRule{}
+}
+
+// loadAccessRules lists the AzureAccessRules in the cluster and replaces the
+// rules from resources with them, ordered by name
+func (az *Azure) loadAccessRules(ctx context.Context, c client.Reader) error {
+	list := &AzureAccessRuleList{}
+	if err := c.List(ctx, list); err != nil {
+		return err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+
+	rules := make(AzureRules, 0, len(list.Items))
+	for _, r := range list.Items {
+		// An invalid rule would fail the evaluation of the rules after
+		// it, so it's left out instead
+		if err := r.Spec.validate(); err != nil {
+			log.Error(err, "ignoring invalid access rule", "kind", "AzureAccessRule", "name", r.Name)
+			continue
+		}
+		rules = append(rules, r.Spec)
+	}
+
+	az.mu.Lock()
+	defer az.mu.Unlock()
+	az.resourceRules = rules
+
+	return nil
+}
+
+func (az *Azure) accessRule() client.Object {
+	return &AzureAccessRule{}
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *AWSRule) DeepCopyInto(out *AWSRule) {
+	*out = *in
+	out.NamespacePatterns = copyStrings(in.NamespacePatterns)
+	out.RoleNamePatterns = copyStrings(in.RoleNamePatterns)
+	out.AccountIDs = copyStrings(in.AccountIDs)
+	out.Partitions = copyStrings(in.Partitions)
+	out.NamespaceSelector = in.NamespaceSelector.DeepCopy()
+	out.ServiceAccountNamePatterns = copyStrings(in.ServiceAccountNamePatterns)
+	out.ServiceAccountSelector = in.ServiceAccountSelector.DeepCopy()
+	out.AllowedExtraPolicies = copyStrings(in.AllowedExtraPolicies)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *GCPRule) DeepCopyInto(out *GCPRule) {
+	*out = *in
+	out.NamespacePatterns = copyStrings(in.NamespacePatterns)
+	out.ServiceAccEmailPatterns = copyStrings(in.ServiceAccEmailPatterns)
+	out.ProjectIDs = copyStrings(in.ProjectIDs)
+	out.AllowedScopes = copyStrings(in.AllowedScopes)
+	out.NamespaceSelector = in.NamespaceSelector.DeepCopy()
+	out.ServiceAccountNamePatterns = copyStrings(in.ServiceAccountNamePatterns)
+	out.ServiceAccountSelector = in.ServiceAccountSelector.DeepCopy()
+	out.AllowedExtraPolicies = copyStrings(in.AllowedExtraPolicies)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *AzureRule) DeepCopyInto(out *AzureRule) {
+	*out = *in
+	out.NamespacePatterns = copyStrings(in.NamespacePatterns)
+	out.SubscriptionIDs = copyStrings(in.SubscriptionIDs)
+	out.ResourceGroupPatterns = copyStrings(in.ResourceGroupPatterns)
+	out.ApplicationObjectIDs = copyStrings(in.ApplicationObjectIDs)
+	out.AllowedRoleNames = copyStrings(in.AllowedRoleNames)
+	out.AllowedExtraPolicies = copyStrings(in.AllowedExtraPolicies)
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *AWSAccessRule) DeepCopyInto(out *AWSAccessRule) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *AWSAccessRule) DeepCopyObject() runtime.Object {
+	out := &AWSAccessRule{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *AWSAccessRuleList) DeepCopyObject() runtime.Object {
+	out := &AWSAccessRuleList{}
+	*out = *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]AWSAccessRule, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *GCPAccessRule) DeepCopyInto(out *GCPAccessRule) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *GCPAccessRule) DeepCopyObject() runtime.Object {
+	out := &GCPAccessRule{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *GCPAccessRuleList) DeepCopyObject() runtime.Object {
+	out := &GCPAccessRuleList{}
+	*out = *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]GCPAccessRule, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
+
+// DeepCopyInto copies the receiver into out
+func (in *AzureAccessRule) DeepCopyInto(out *AzureAccessRule) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *AzureAccessRule) DeepCopyObject() runtime.Object {
+	out := &AzureAccessRule{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject returns a deep copy of the receiver
+func (in *AzureAccessRuleList) DeepCopyObject() runtime.Object {
+	out := &AzureAccessRuleList{}
+	*out = *in
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]AzureAccessRule, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
+
+func copyStrings(in []string) []string {
+	if in == nil {
+		return nil
+	}
+	out := make([]string, len(in))
+	copy(out, in)
+	return out
+}
@@ -0,0 +1,233 @@
+package operator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// TestAccessRulesChanged tests that access rule resources are evaluated after
+// the rules from the config file and that a change to them enqueues the
+// annotated service accounts
+func TestAccessRulesChanged(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = AddToScheme(scheme)
+
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			&AWSAccessRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "b-rule"},
+				Spec: AWSRule{
+					NamespacePatterns: []string{"bar"},
+					RoleNamePatterns:  []string{"bar-*"},
+				},
+			},
+			&AWSAccessRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "a-rule"},
+				Spec: AWSRule{
+					NamespacePatterns: []string{"baz"},
+					RoleNamePatterns:  []string{"baz-*"},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "annotated",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+					},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "not-annotated",
+					Namespace: "bar",
+				},
+			},
+		).
+		Build()
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+	o, _ := NewOperator(&Config{
+		KubeClient:       kubeClient,
+		WatchAccessRules: true,
+	}, aws)
+
+	// Test that the access rules aren't evaluated before they're loaded
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+
+	requests := o.accessRulesChanged(context.Background(), nil)
+	assert.Equal(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "bar", Name: "annotated"}},
+	}, requests)
+
+	// Test that the rules are ordered by name after the config file rules
+	assert.Equal(t, []string{"baz"}, aws.resourceRules[0].NamespacePatterns)
+	assert.Equal(t, []string{"bar"}, aws.resourceRules[1].NamespacePatterns)
+
+	// Test that both the config file and the access rules are evaluated
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("baz", awsRoleAnnotation, "arn:aws:iam::111111111111:role/baz-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+
+	// Test that removing a rule revokes access
+	assert.NoError(t, kubeClient.Delete(context.Background(), &AWSAccessRule{ObjectMeta: metav1.ObjectMeta{Name: "b-rule"}}))
+	o.accessRulesChanged(context.Background(), nil)
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+
+	// Test that the config file rules aren't modified by appending the
+	// access rules
+	assert.Len(t, aws.Rules, 1)
+}
+
+// TestAccessRulesEmpty tests that, when access rules are watched, they're
+// loaded before the first reconcile and that an empty set of rules denies
+// every service account rather than allowing all of them
+func TestAccessRulesEmpty(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = AddToScheme(scheme)
+
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			&AWSAccessRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "rule"},
+				Spec: AWSRule{
+					NamespacePatterns: []string{"bar"},
+					RoleNamePatterns:  []string{"bar-*"},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "foo",
+					Namespace: "bar",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+					},
+				},
+			},
+		).
+		Build()
+
+	var writes []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writes = append(writes, r.Method+" "+r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+		WatchAccessRules:      true,
+	}, aws)
+
+	// Test that nothing is admitted before the access rules are loaded,
+	// even though there are no rules in the config file
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+
+	// Test that the first reconcile loads the access rules, so the service
+	// account they allow is written rather than removed
+	_, err = o.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "bar", Name: "foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"PUT /v1/sys/policy/vkcc_aws_bar_foo",
+		"PUT /v1/auth/kubernetes/role/vkcc_aws_bar_foo",
+		"PUT /v1/aws/roles/vkcc_aws_bar_foo",
+	}, writes)
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+
+	// Test that removing the last access rule denies everything
+	assert.NoError(t, kubeClient.Delete(context.Background(), &AWSAccessRule{ObjectMeta: metav1.ObjectMeta{Name: "rule"}}))
+	o.accessRulesChanged(context.Background(), nil)
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar-role is not allowed, there are no aws.rules or access rules", o.deniedReason(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+}
+
+// TestAccessRulesPolicyTemplate tests that the policy templates of access rule
+// resources are ignored, since they can grant anything in vault
+func TestAccessRulesPolicyTemplate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = AddToScheme(scheme)
+
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			&AWSAccessRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "aws-rule"},
+				Spec: AWSRule{
+					NamespacePatterns: []string{"foo"},
+					RoleNamePatterns:  []string{"foo"},
+					PolicyTemplate:    `path "*" { capabilities = ["sudo"] }`,
+				},
+			},
+			&GCPAccessRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "gcp-rule"},
+				Spec: GCPRule{
+					NamespacePatterns:       []string{"foo"},
+					ServiceAccEmailPatterns: []string{"foo@bar.iam.gserviceaccount.com"},
+					PolicyTemplate:          `path "*" { capabilities = ["sudo"] }`,
+				},
+			},
+		).
+		Build()
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	assert.NoError(t, aws.loadAccessRules(context.Background(), kubeClient))
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	rule := matchRule(t, aws, serviceAccount)
+	assert.Equal(t, 0, rule.index)
+	policy, err := aws.renderPolicyTemplate("vkcc_aws_foo_foo", serviceAccount, rule)
+	if assert.NoError(t, err) {
+		assert.Contains(t, policy, `path "aws/sts/vkcc_aws_foo_foo"`)
+		assert.NotContains(t, policy, `path "*"`)
+	}
+
+	gcp, _ := NewGCPProvider(defaultFileConfig.GCP)
+	assert.NoError(t, gcp.loadAccessRules(context.Background(), kubeClient))
+	serviceAccount = annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+	rule = matchRule(t, gcp, serviceAccount)
+	assert.Equal(t, 0, rule.index)
+	policy, err = gcp.renderPolicyTemplate("vkcc_gcp_foo_foo", serviceAccount, rule)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, policy, `path "*"`)
+	}
+}
@@ -1,10 +1,11 @@
 package operator
 
 import (
-	"bytes"
 	"fmt"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -17,6 +18,7 @@ const (
 	awsRoleAnnotation       = "vault.uw.systems/aws-role"
 	defaultSTSTTLAnnotation = "vault.uw.systems/default-sts-ttl"
 	maxSTSTTLDuration       = 12 * time.Hour
+	minSTSTTLDuration       = 15 * time.Minute
 )
 
 var awsPolicyTemplate = `
@@ -34,9 +36,44 @@ type AWSRules []AWSRule
 // AWSRule restricts the arns that a service account can assume based on
 // patterns which match its namespace to an arn or arns
 type AWSRule struct {
-	NamespacePatterns []string `yaml:"namespacePatterns"`
-	RoleNamePatterns  []string `yaml:"roleNamePatterns"`
-	AccountIDs        []string `yaml:"accountIDs"`
+	NamespacePatterns []string `yaml:"namespacePatterns" json:"namespacePatterns,omitempty"`
+	RoleNamePatterns  []string `yaml:"roleNamePatterns" json:"roleNamePatterns,omitempty"`
+	AccountIDs        []string `yaml:"accountIDs" json:"accountIDs,omitempty"`
+	// Partitions that the roles can belong to, any partition if empty
+	Partitions []string `yaml:"partitions" json:"partitions,omitempty"`
+	// NamespaceSelector must also match the labels of the namespace of
+	// the service account. The namespace patterns aren't required with a
+	// selector.
+	NamespaceSelector *LabelSelector `yaml:"namespaceSelector" json:"namespaceSelector,omitempty"`
+	// ServiceAccountNamePatterns and ServiceAccountSelector narrow the
+	// rule to service accounts with matching names and labels
+	ServiceAccountNamePatterns []string       `yaml:"serviceAccountNamePatterns" json:"serviceAccountNamePatterns,omitempty"`
+	ServiceAccountSelector     *LabelSelector `yaml:"serviceAccountSelector" json:"serviceAccountSelector,omitempty"`
+	// RoleTemplate is rendered with the namespace and name of service
+	// accounts annotated with auto, to give them a role that the rule
+	// allows without writing out its arn
+	RoleTemplate string `yaml:"roleTemplate" json:"roleTemplate,omitempty"`
+	// DefaultTTL, MinTTL and MaxTTL override the ttl settings of the
+	// provider for the service accounts that the rule admits
+	DefaultTTL Duration `yaml:"defaultTTL" json:"defaultTTL,omitzero"`
+	MinTTL     Duration `yaml:"minTTL" json:"minTTL,omitzero"`
+	MaxTTL     Duration `yaml:"maxTTL" json:"maxTTL,omitzero"`
+	// AllowedExtraPolicies are patterns matching the policies that the
+	// service accounts which the rule admits can list in their
+	// extra-policies annotation
+	AllowedExtraPolicies []string `yaml:"allowedExtraPolicies" json:"allowedExtraPolicies,omitempty"`
+	// VaultNamespace is the vault namespace that the objects of the
+	// service accounts which the rule admits are written to, instead of
+	// the namespace of the operator
+	VaultNamespace string `yaml:"vaultNamespace" json:"vaultNamespace,omitempty"`
+	// PolicyTemplate replaces the policy of the provider for the service
+	// accounts that the rule admits. It's ignored on access rule
+	// resources.
+	PolicyTemplate string `yaml:"policyTemplate" json:"policyTemplate,omitempty"`
+	// Expression is a CEL expression that must also evaluate to true for
+	// the rule to match. Patterns that aren't set don't restrict a rule
+	// with an expression.
+	Expression string `yaml:"expression" json:"expression,omitempty"`
 }
 
 // AWSOperatorConfig provides configuration when creating a new Operator
@@ -44,23 +81,31 @@ type AWS struct {
 	DefaultTTL time.Duration
 	MinTTL     time.Duration
 	Path       string
-	Rules      AWSRules
-	tmpl       *template.Template
+	// PartitionPaths are the mount paths for roles in other partitions
+	PartitionPaths map[string]string
+	Rules          AWSRules
+	tmpl           *template.Template
+
+	// mu guards the rules, ttl settings and policy template, which are
+	// replaced when the config file or the AWSAccessRule resources change
+	mu            sync.RWMutex
+	resourceRules AWSRules
 }
 
 // NewAWSProvider returns a configured AWS provider config
 func NewAWSProvider(config awsFileConfig) (*AWS, error) {
-	tmpl, err := template.New("policy").Parse(awsPolicyTemplate)
+	tmpl, err := parseProviderPolicyTemplate(awsPolicyTemplate, config.PolicyTemplate)
 	if err != nil {
 		return nil, err
 	}
 
 	return &AWS{
-		DefaultTTL: config.DefaultTTL,
-		MinTTL:     config.MinTTL,
-		tmpl:       tmpl,
-		Path:       config.Path,
-		Rules:      config.Rules,
+		DefaultTTL:     config.DefaultTTL,
+		MinTTL:         config.MinTTL,
+		tmpl:           tmpl,
+		Path:           config.Path,
+		PartitionPaths: config.PartitionPaths,
+		Rules:          config.Rules,
 	}, nil
 }
 
@@ -74,43 +119,91 @@ func (a *AWS) secretIdentityAnnotation() string {
 	return awsRoleAnnotation
 }
 
-func (a *AWS) secretPath() string {
-	return a.Path + "/roles/"
+// partitionPath returns the mount path of the secret backend for the
+// partition of the role arn. Roles in partitions without their own path, and
+// invalid arns, use the default path.
+func (a *AWS) partitionPath(roleArn string) string {
+	if parsed, err := arn.Parse(roleArn); err == nil {
+		if path, ok := a.PartitionPaths[parsed.Partition]; ok {
+			return path
+		}
+	}
+
+	return a.Path
 }
 
-func (a *AWS) processUpdateEvent(e event.UpdateEvent) bool {
-	return e.ObjectOld.GetAnnotations()[awsRoleAnnotation] != e.ObjectNew.GetAnnotations()[awsRoleAnnotation] ||
-		e.ObjectOld.GetAnnotations()[defaultSTSTTLAnnotation] != e.ObjectNew.GetAnnotations()[defaultSTSTTLAnnotation]
+func (a *AWS) secretPath(roleArn string) string {
+	return a.partitionPath(roleArn) + "/roles/"
 }
 
-func (a *AWS) secretTTL(serviceAccount *corev1.ServiceAccount) (time.Duration, error) {
-	var err error
-	// check if default-sts-ttl is set if not use config default
-	secretTTL := a.DefaultTTL
-	if v, ok := serviceAccount.Annotations[defaultSTSTTLAnnotation]; ok {
-		secretTTL, err = time.ParseDuration(v)
-		if err != nil {
-			return 0, fmt.Errorf("error parsing default_sts_ttl %w", err)
+// secretPaths returns the paths of the roles in every partition
+func (a *AWS) secretPaths() []string {
+	paths := []string{a.Path + "/roles/"}
+	for _, path := range a.PartitionPaths {
+		if !slices.Contains(paths, path+"/roles/") {
+			paths = append(paths, path+"/roles/")
 		}
 	}
+	slices.Sort(paths[1:])
 
-	if secretTTL < a.MinTTL {
-		return 0, fmt.Errorf("minimum default-sts-ttl value allowed is %s, its set to %s", a.MinTTL, secretTTL)
-	}
-	if secretTTL > maxSTSTTLDuration {
-		return 0, fmt.Errorf("maximum default-sts-ttl value allowed is %s, its set to %s", maxSTSTTLDuration, secretTTL)
+	return paths
+}
+
+// vaultNamespaces returns the distinct vault namespaces set by the rules
+func (a *AWS) vaultNamespaces() []string {
+	var vaultNamespaces []string
+	for _, r := range a.rules() {
+		if r.VaultNamespace != "" && !slices.Contains(vaultNamespaces, r.VaultNamespace) {
+			vaultNamespaces = append(vaultNamespaces, r.VaultNamespace)
+		}
 	}
 
-	return secretTTL, nil
+	return vaultNamespaces
 }
 
-func (a *AWS) secretPayload(serviceAccount *corev1.ServiceAccount) (map[string]interface{}, error) {
+func (a *AWS) processUpdateEvent(e event.UpdateEvent) bool {
+	return e.ObjectOld.GetAnnotations()[awsRoleAnnotation] != e.ObjectNew.GetAnnotations()[awsRoleAnnotation] ||
+		e.ObjectOld.GetAnnotations()[defaultSTSTTLAnnotation] != e.ObjectNew.GetAnnotations()[defaultSTSTTLAnnotation]
+}
 
-	secretTTL, err := a.secretTTL(serviceAccount)
+// updateConfig replaces the rules, ttl settings and policy template with those
+// in the provided config
+func (a *AWS) updateConfig(fc *fileConfig) {
+	// The template has been validated when the config was loaded
+	tmpl, err := parseProviderPolicyTemplate(awsPolicyTemplate, fc.AWS.PolicyTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("unable to set secret ttl err: %w", err)
+		log.Error(err, "error parsing policy template, keeping the current one", "provider", a.name())
 	}
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if tmpl != nil {
+		a.tmpl = tmpl
+	}
+	a.DefaultTTL = fc.AWS.DefaultTTL
+	a.MinTTL = fc.AWS.MinTTL
+	a.Rules = fc.AWS.Rules
+}
+
+// secretTTL returns the ttl in the default-sts-ttl annotation of the service
+// account, or the default ttl, within the bounds of the rule that admits it or
+// of the provider
+func (a *AWS) secretTTL(serviceAccount *corev1.ServiceAccount, rule matchedRule) (time.Duration, error) {
+	a.mu.RLock()
+	bounds := ttlBounds{defaultTTL: a.DefaultTTL, minTTL: a.MinTTL, maxTTL: maxSTSTTLDuration}
+	a.mu.RUnlock()
+
+	bounds = bounds.withRule(rule)
+	// STS doesn't issue credentials for less than 15m, whatever the config
+	if bounds.minTTL < minSTSTTLDuration {
+		bounds.minTTL = minSTSTTLDuration
+	}
+
+	return bounds.secretTTL(serviceAccount, defaultSTSTTLAnnotation)
+}
+
+func (a *AWS) secretPayload(serviceAccount *corev1.ServiceAccount, secretTTL time.Duration) (map[string]interface{}, error) {
 	return map[string]interface{}{
 		"default_sts_ttl": int(secretTTL.Seconds()),
 		"role_arns":       []string{serviceAccount.Annotations[awsRoleAnnotation]},
@@ -124,67 +217,256 @@ func (a *AWS) secretPayload(serviceAccount *corev1.ServiceAccount) (map[string]i
 }
 
 // renderAWSPolicyTemplate injects the provided name into a policy allowing access
-// to the corresponding AWS secret role
-func (a *AWS) renderPolicyTemplate(name string) (string, error) {
-	var policy bytes.Buffer
-	if err := a.tmpl.Execute(&policy, struct {
-		Path string
-		Name string
-	}{
-		Path: a.Path,
-		Name: name,
-	}); err != nil {
-		return "", err
+// to the corresponding AWS secret role, in the secret backend for the partition
+// of the role. The policy template of the rule that admits the service account
+// is used instead of the provider's, if it has one.
+func (a *AWS) renderPolicyTemplate(name string, serviceAccount *corev1.ServiceAccount, rule matchedRule) (string, error) {
+	a.mu.RLock()
+	tmpl := a.tmpl
+	a.mu.RUnlock()
+
+	if rule.policyTemplate != "" {
+		var err error
+		if tmpl, err = parsePolicyTemplate(rule.policyTemplate); err != nil {
+			return "", err
+		}
+	}
+
+	return renderPolicy(tmpl, policyTemplateData{
+		Namespace:      serviceAccount.Namespace,
+		ServiceAccount: serviceAccount.Name,
+		Name:           name,
+		Path:           a.partitionPath(serviceAccount.Annotations[awsRoleAnnotation]),
+	})
+}
+
+// rules returns the rules from the config file followed by the rules from
+// AWSAccessRule resources
+func (a *AWS) rules() AWSRules {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append(a.Rules[:len(a.Rules):len(a.Rules)], a.resourceRules...)
+}
+
+// hasRules returns true if there are rules in the config file or from
+// AWSAccessRule resources
+func (a *AWS) hasRules() bool {
+	return len(a.rules()) > 0
+}
+
+func (a *AWS) selectsNamespaces() bool {
+	for _, r := range a.rules() {
+		if r.NamespaceSelector != nil {
+			return true
+		}
 	}
 
-	return policy.String(), nil
+	return false
 }
 
-func (a *AWS) allow(namespace, roleArn string) (bool, error) {
-	return a.Rules.allow(namespace, roleArn)
+func (a *AWS) matchRule(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error) {
+	return a.rules().matchRule(serviceAccount, namespaceLabels)
 }
 
 // allow returns true if there is a rule in the list of rules which allows
-// a service account in the given namespace to assume the given role. Rules are
-// evaluated in order and allow returns true for the first matching rule in the
-// list
-func (ar AWSRules) allow(namespace, roleArn string) (bool, error) {
-	a, err := arn.Parse(roleArn)
+// the service account, in a namespace with the given labels, to assume the role
+// in its annotation. Rules are evaluated in order and allow returns true for
+// the first matching rule in the list
+func (ar AWSRules) allow(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (bool, error) {
+	i, err := ar.match(serviceAccount, namespaceLabels)
 	if err != nil {
 		return false, err
 	}
 
-	for _, r := range ar {
-		allowed, err := r.allows(namespace, a)
+	if i >= 0 || len(ar) > 0 {
+		return i >= 0, nil
+	}
+
+	// Without rules there isn't a template to render a role from, or
+	// patterns to allow extra policies
+	if err := checkExtraPolicies(serviceAccount, nil); err != nil {
+		return false, err
+	}
+
+	return serviceAccount.Annotations[awsRoleAnnotation] != autoIdentity, nil
+}
+
+// match returns the index of the first rule in the list which allows the
+// service account to assume the role in its annotation, or -1 if none of them
+// do. A service account annotated with auto is matched by the first rule that
+// allows the role rendered from its template.
+func (ar AWSRules) match(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (int, error) {
+	if serviceAccount.Annotations[awsRoleAnnotation] == autoIdentity {
+		return ar.matchTemplate(serviceAccount, namespaceLabels)
+	}
+
+	a, err := parseRoleArn(serviceAccount.Annotations[awsRoleAnnotation])
+	if err != nil {
+		return -1, err
+	}
+
+	for i, r := range ar {
+		allowed, err := r.allows(serviceAccount, namespaceLabels, a)
 		if err != nil {
-			return false, err
+			return -1, err
 		}
 		if allowed {
-			return true, nil
+			return i, nil
 		}
 	}
 
-	return len(ar) == 0, nil
+	return -1, nil
 }
 
-// allows checks whether this rule allows a namespace to assume the given role_arn
-func (ar *AWSRule) allows(namespace string, roleArn arn.ARN) (bool, error) {
-	accountIDAllowed := ar.matchesAccountID(roleArn.AccountID)
+// matchTemplate returns the index of the first rule in the list with a role
+// template which allows the service account to assume the rendered role, or -1
+// if none of them do
+func (ar AWSRules) matchTemplate(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (int, error) {
+	for i, r := range ar {
+		if r.RoleTemplate == "" {
+			continue
+		}
+
+		roleArn, err := renderIdentityTemplate(r.RoleTemplate, serviceAccount)
+		if err != nil {
+			return -1, err
+		}
+		a, err := parseRoleArn(roleArn)
+		if err != nil {
+			return -1, fmt.Errorf("invalid role rendered from roleTemplate: %w", err)
+		}
 
-	namespaceAllowed, err := matchesNamespace(namespace, ar.NamespacePatterns)
+		allowed, err := r.allows(serviceAccount, namespaceLabels, a)
+		if err != nil {
+			return -1, err
+		}
+		if allowed {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// matchRule returns the first rule in the list which allows the service
+// account, with the role in its annotation or the role rendered from the
+// template of the rule if it's annotated with auto
+func (ar AWSRules) matchRule(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error) {
+	rule := matchedRule{index: -1, identity: serviceAccount.Annotations[awsRoleAnnotation]}
+
+	i, err := ar.match(serviceAccount, namespaceLabels)
+	if err != nil {
+		return rule, err
+	}
+	if i < 0 {
+		rule.allowed, err = ar.allow(serviceAccount, namespaceLabels)
+		return rule, err
+	}
+
+	r := ar[i]
+	if rule.identity == autoIdentity {
+		if rule.identity, err = renderIdentityTemplate(r.RoleTemplate, serviceAccount); err != nil {
+			return rule, err
+		}
+	}
+	rule.index = i
+	rule.allowed = true
+	rule.defaultTTL = r.DefaultTTL
+	rule.minTTL = r.MinTTL
+	rule.maxTTL = r.MaxTTL
+	rule.policyTemplate = r.PolicyTemplate
+	rule.vaultNamespace = r.VaultNamespace
+
+	return rule, nil
+}
+
+// allows checks whether this rule allows a service account in a namespace with
+// the given labels to assume the given role_arn
+func (ar *AWSRule) allows(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string, roleArn arn.ARN) (bool, error) {
+	if !strings.HasPrefix(roleArn.Resource, "role/") {
+		return false, nil
+	}
+
+	accountIDAllowed := ar.matchesAccountID(roleArn.AccountID) && ar.matchesPartition(roleArn.Partition)
+
+	namespaceAllowed, err := matchesNamespace(serviceAccount.Namespace, ar.NamespacePatterns)
 	if err != nil {
 		return false, err
 	}
+	namespaceAllowed = namespaceAllowed || (len(ar.NamespacePatterns) == 0 && (ar.NamespaceSelector != nil || ar.Expression != ""))
 
-	roleAllowed := false
-	if strings.HasPrefix(roleArn.Resource, "role/") {
-		roleAllowed, err = ar.matchesRoleName(strings.TrimPrefix(roleArn.Resource, "role/"))
-		if err != nil {
+	selectorAllowed, err := ar.NamespaceSelector.matches(namespaceLabels)
+	if err != nil {
+		return false, err
+	}
+
+	serviceAccountAllowed, err := ar.matchesServiceAccount(serviceAccount)
+	if err != nil {
+		return false, err
+	}
+
+	roleAllowed, err := ar.matchesRoleName(strings.TrimPrefix(roleArn.Resource, "role/"))
+	if err != nil {
+		return false, err
+	}
+	roleAllowed = roleAllowed || (len(ar.RoleNamePatterns) == 0 && ar.Expression != "")
+
+	if !accountIDAllowed || !namespaceAllowed || !selectorAllowed || !serviceAccountAllowed || !roleAllowed {
+		return false, nil
+	}
+	if ar.Expression != "" {
+		allowed, err := evalExpression("aws", ar.Expression, serviceAccount, awsExpressionVars(roleArn))
+		if err != nil || !allowed {
 			return false, err
 		}
 	}
 
-	return accountIDAllowed && namespaceAllowed && roleAllowed, nil
+	// The rule that allows the role decides the extra policies, so a policy
+	// that it doesn't allow is an error rather than a reason to try the
+	// next rule
+	return true, checkExtraPolicies(serviceAccount, ar.AllowedExtraPolicies)
+}
+
+// matchesServiceAccount returns true if the rule allows the name and labels of
+// the service account
+func (ar *AWSRule) matchesServiceAccount(serviceAccount *corev1.ServiceAccount) (bool, error) {
+	nameAllowed, err := matchesServiceAccountName(serviceAccount.Name, ar.ServiceAccountNamePatterns)
+	if err != nil || !nameAllowed {
+		return false, err
+	}
+
+	return ar.ServiceAccountSelector.matches(serviceAccount.Labels)
+}
+
+// validate checks that the selectors and the role and policy templates of the
+// rule can be parsed and that its expression compiles
+func (ar *AWSRule) validate() error {
+	if err := ar.NamespaceSelector.validate("namespaceSelector"); err != nil {
+		return err
+	}
+	if err := ar.ServiceAccountSelector.validate("serviceAccountSelector"); err != nil {
+		return err
+	}
+	if _, err := parseIdentityTemplate(ar.RoleTemplate); err != nil {
+		return fmt.Errorf("invalid roleTemplate: %w", err)
+	}
+	if err := validateTTLs(ar.DefaultTTL, ar.MinTTL, ar.MaxTTL, minSTSTTLDuration, maxSTSTTLDuration); err != nil {
+		return err
+	}
+	if ar.PolicyTemplate != "" {
+		if _, err := parsePolicyTemplate(ar.PolicyTemplate); err != nil {
+			return fmt.Errorf("invalid policyTemplate: %w", err)
+		}
+	}
+	if ar.Expression == "" {
+		return nil
+	}
+	if _, err := compileExpression("aws", ar.Expression); err != nil {
+		return fmt.Errorf("invalid expression: %w", err)
+	}
+
+	return nil
 }
 
 // matchesAccountID returns true if the rule allows an accountID, or if it
@@ -199,6 +481,25 @@ func (ar *AWSRule) matchesAccountID(accountID string) bool {
 	return len(ar.AccountIDs) == 0
 }
 
+// matchesPartition returns true if the rule allows a partition, or if it
+// doesn't contain any partitions at all
+func (ar *AWSRule) matchesPartition(partition string) bool {
+	return len(ar.Partitions) == 0 || slices.Contains(ar.Partitions, partition)
+}
+
+// parseRoleArn parses a role arn, which must be an IAM arn
+func parseRoleArn(roleArn string) (arn.ARN, error) {
+	a, err := arn.Parse(roleArn)
+	if err != nil {
+		return arn.ARN{}, err
+	}
+	if a.Service != "iam" {
+		return arn.ARN{}, fmt.Errorf("role arn must be an iam arn, not %s", a.Service)
+	}
+
+	return a, nil
+}
+
 // matchesRoleName returns true if the rule allows the given role name
 func (ar *AWSRule) matchesRoleName(roleName string) (bool, error) {
 	for _, rp := range ar.RoleNamePatterns {
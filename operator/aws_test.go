@@ -3,6 +3,7 @@ package operator
 import (
 	"testing"
 
+	"github.com/go-logr/logr/funcr"
 	"github.com/stretchr/testify/assert"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -477,17 +478,17 @@ func TestAWSOperatorAdmitEvent(t *testing.T) {
 	o, _ := NewOperator(config, aws)
 
 	// Test that without any rules any valid event is admitted
-	assert.True(t, o.admitEvent("foobar", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foobar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foobar-role")))
 
 	// Test that an empty role is not admitted
-	assert.False(t, o.admitEvent("foobar", ""))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", awsRoleAnnotation, "")))
 
 	// Test that an invalid role is not admitted
-	assert.False(t, o.admitEvent("foobar", "foobar"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", awsRoleAnnotation, "foobar")))
 
 	// Test that a malformed arn is not admitted (missing a second : after
 	// iam)
-	assert.False(t, o.admitEvent("foobar", "arn:aws:iam:111111111111:role/foobar-role"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", awsRoleAnnotation, "arn:aws:iam:111111111111:role/foobar-role")))
 
 	aws.Rules = AWSRules{
 		AWSRule{
@@ -527,41 +528,149 @@ func TestAWSOperatorAdmitEvent(t *testing.T) {
 	}
 
 	// Test bar-* : foobar-* is allowed
-	assert.True(t, o.admitEvent("bar-foo", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar-foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foobar-role")))
 
 	// Test that foo : barfoo/* is allowed
-	assert.True(t, o.admitEvent("foo", "arn:aws:iam::111111111111:role/barfoo/role"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/barfoo/role")))
 
 	// Test that another account ID from the list is matched
-	assert.True(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/barfoo/role"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::000000000000:role/barfoo/role")))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/organisation"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws:iam::000000000000:role/organisation")))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/org-admins/test-subdivision/foobar"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws:iam::000000000000:role/org-admins/test-subdivision/foobar")))
 
 	// Test the ? match
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/system"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws:iam::000000000000:role/system")))
 
 	// Test that foo : barfoo is not allowed
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::111111111111:role/barfoo"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/barfoo")))
 
 	// Test that the matching doesn't match the namespace foo to foobar as a
 	// substring
-	assert.False(t, o.admitEvent("foobar", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foobar-role")))
 
 	// Test that an account ID outside of the list is not allowed
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::222222222222:role/barfoo/role"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::222222222222:role/barfoo/role")))
 
 	// Test that the rules don't mix
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/organisation"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::000000000000:role/organisation")))
 
 	// Test that a rule without a namespace pattern does not admit
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/fuubar-role"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::000000000000:role/fuubar-role")))
 
 	// Test that a rule without a role pattern does not admit
-	assert.False(t, o.admitEvent("fuubar", "arn:aws:iam::000000000000:role/fuubar-role"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("fuubar", awsRoleAnnotation, "arn:aws:iam::000000000000:role/fuubar-role")))
+}
+
+// TestAWSOperatorAdmitEventExpression tests that rule expressions are evaluated
+// along with the patterns
+func TestAWSOperatorAdmitEventExpression(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			AccountIDs: []string{
+				"111111111111",
+			},
+			Expression: `arn.roleName.startsWith(serviceAccount.namespace + "-") && arn.path == "/team/"`,
+		},
+		AWSRule{
+			NamespacePatterns: []string{
+				"bar",
+			},
+			Expression: `serviceAccount.labels["team"] == "bar"`,
+		},
+	}
+
+	// Test that the expression can refer to the namespace and the parts of
+	// the arn
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/team/foo-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/team/bar-role")))
+
+	// Test that the patterns are still applied with an expression
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::222222222222:role/team/foo-role")))
+
+	// Test that the expression can refer to the labels of the service
+	// account
+	serviceAccount := annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::222222222222:role/any")
+	assert.False(t, o.admitEvent(serviceAccount))
+	serviceAccount.Labels = map[string]string{"team": "bar"}
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Namespace = "baz"
+	assert.False(t, o.admitEvent(serviceAccount))
+}
+
+// TestAWSOperatorAdmitEventExpressionError tests that an expression which fails
+// at runtime doesn't match, and that the rules after it are still evaluated
+func TestAWSOperatorAdmitEventExpressionError(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			// Fails for service accounts without the label
+			Expression: `serviceAccount.labels["team"] == "foo"`,
+		},
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")
+	assert.True(t, o.admitEvent(serviceAccount))
+	rule, err := aws.matchRule(serviceAccount, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rule.index)
+
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")))
+
+	// The first rule matches once the label is there
+	serviceAccount.Labels = map[string]string{"team": "foo"}
+	rule, err = aws.matchRule(serviceAccount, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rule.index)
+}
+
+// TestAWSOperatorAdmitEventServiceAccount tests that rules can be narrowed to
+// service accounts by their names and labels
+func TestAWSOperatorAdmitEventServiceAccount(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns:          []string{"kube-system"},
+			RoleNamePatterns:           []string{"sysadmin-*"},
+			ServiceAccountNamePatterns: []string{"cluster-*"},
+			ServiceAccountSelector: &LabelSelector{
+				MatchLabels: map[string]string{"app": "admin"},
+			},
+		},
+	}
+
+	serviceAccount := annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws:iam::111111111111:role/sysadmin-role")
+	serviceAccount.Labels = map[string]string{"app": "admin"}
+
+	// Test that the name must match the patterns
+	assert.False(t, o.admitEvent(serviceAccount))
+	serviceAccount.Name = "cluster-admin"
+	assert.True(t, o.admitEvent(serviceAccount))
+
+	// Test that the labels must match the selector
+	serviceAccount.Labels = map[string]string{"app": "other"}
+	assert.False(t, o.admitEvent(serviceAccount))
 }
 
 //// fakeVaultCluster creates a mock vault cluster with the kubernetes credential
@@ -602,3 +711,94 @@ func TestAWSOperatorAdmitEvent(t *testing.T) {
 //	}
 //	return cluster
 //}
+
+func TestAWSOperatorAdmitEventPartition(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"kube-system"},
+			RoleNamePatterns:  []string{"sysadmin-*"},
+			Partitions:        []string{"aws-cn"},
+		},
+	}
+
+	// Test that the partition must be in the rule
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws-cn:iam::111111111111:role/sysadmin-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws:iam::111111111111:role/sysadmin-role")))
+
+	// Test that arns for other services are denied, even when the resource
+	// looks like a role
+	assert.False(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws-cn:s3::111111111111:role/sysadmin-role")))
+
+	aws.Rules = AWSRules{}
+	assert.False(t, o.admitEvent(annotatedServiceAccount("kube-system", awsRoleAnnotation, "arn:aws-cn:s3::111111111111:role/sysadmin-role")))
+}
+
+func TestAWSPartitionPaths(t *testing.T) {
+	aws, _ := NewAWSProvider(awsFileConfig{
+		Path:           "aws",
+		PartitionPaths: map[string]string{"aws-cn": "aws-cn", "aws-us-gov": "aws-gov"},
+	})
+
+	assert.Equal(t, "aws/roles/", aws.secretPath("arn:aws:iam::111111111111:role/foo"))
+	assert.Equal(t, "aws-cn/roles/", aws.secretPath("arn:aws-cn:iam::111111111111:role/foo"))
+	assert.Equal(t, "aws-gov/roles/", aws.secretPath("arn:aws-us-gov:iam::111111111111:role/foo"))
+	assert.Equal(t, "aws/roles/", aws.secretPath("arn:aws-iso:iam::111111111111:role/foo"))
+	assert.Equal(t, []string{"aws/roles/", "aws-cn/roles/", "aws-gov/roles/"}, aws.secretPaths())
+
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws-cn:iam::111111111111:role/foo")
+	policy, err := aws.renderPolicyTemplate("foo", serviceAccount, matchRule(t, aws, serviceAccount))
+	if assert.NoError(t, err) {
+		assert.Contains(t, policy, `path "aws-cn/creds/foo"`)
+		assert.NotContains(t, policy, `path "aws/`)
+	}
+}
+
+// TestAWSOperatorAdmitEventExpressionErrorLogged tests that an expression
+// error is logged once until the rules are loaded again, and that an
+// expression that exceeds the cost limit doesn't match
+func TestAWSOperatorAdmitEventExpressionErrorLogged(t *testing.T) {
+	var logged []string
+	defaultLog := log
+	log = funcr.New(func(prefix, args string) {
+		logged = append(logged, args)
+	}, funcr.Options{})
+	defer func() { log = defaultLog }()
+
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			// Fails for service accounts without the label
+			Expression: `serviceAccount.labels["logged"] == "foo"`,
+		},
+	}
+
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.Len(t, logged, 1)
+
+	o.updateConfig(&fileConfig{AWS: awsFileConfig{Rules: aws.Rules}})
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	assert.Len(t, logged, 2)
+
+	// An expression that iterates too many times is stopped by the cost
+	// limit
+	digits := "[0, 1, 2, 3, 4, 5, 6, 7, 8, 9]"
+	aws.Rules = AWSRules{
+		AWSRule{
+			Expression: digits + ".all(a, " + digits + ".all(b, " + digits + ".all(c, " + digits + ".all(d, " + digits + ".all(e, a + b + c + d + e >= 0)))))",
+		},
+	}
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")))
+	if assert.Len(t, logged, 3) {
+		assert.Contains(t, logged[2], "cost limit exceeded")
+	}
+}
@@ -0,0 +1,471 @@
+package operator
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const (
+	azureRoleAnnotation          = "vault.uw.systems/azure-role"
+	azureRoleNameAnnotation      = "vault.uw.systems/azure-role-name"
+	defaultAzureTTLAnnotation    = "vault.uw.systems/default-azure-ttl"
+	defaultAzureRoleName         = "Reader"
+	azureScopeSubscriptionPrefix = "/subscriptions/"
+)
+
+var azurePolicyTemplate = `
+path "{{ .Path }}/creds/{{ .Name }}" {
+  capabilities = ["read"]
+}
+`
+
+var azureObjectIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// AzureRules are a collection of rules.
+type AzureRules []AzureRule
+
+// AzureRule restricts the Azure identities that a k8s serviceAccount can use
+// based on patterns which match its namespace to subscriptions, resource
+// groups or existing application object IDs
+type AzureRule struct {
+	NamespacePatterns     []string `yaml:"namespacePatterns" json:"namespacePatterns,omitempty"`
+	SubscriptionIDs       []string `yaml:"subscriptionIDs" json:"subscriptionIDs,omitempty"`
+	ResourceGroupPatterns []string `yaml:"resourceGroupPatterns" json:"resourceGroupPatterns,omitempty"`
+	ApplicationObjectIDs  []string `yaml:"applicationObjectIDs" json:"applicationObjectIDs,omitempty"`
+	// AllowedRoleNames are the roles that the service accounts which the
+	// rule admits can request in their azure-role-name annotation, which
+	// is only Reader if it's empty
+	AllowedRoleNames []string `yaml:"allowedRoleNames" json:"allowedRoleNames,omitempty"`
+	// AllowedExtraPolicies are patterns matching the policies that the
+	// service accounts which the rule admits can list in their
+	// extra-policies annotation
+	AllowedExtraPolicies []string `yaml:"allowedExtraPolicies" json:"allowedExtraPolicies,omitempty"`
+	// VaultNamespace is the vault namespace that the objects of the
+	// service accounts which the rule admits are written to, instead of
+	// the namespace of the operator
+	VaultNamespace string `yaml:"vaultNamespace" json:"vaultNamespace,omitempty"`
+}
+
+// azureIdentity is the parsed value of the azure-role annotation. It is either
+// a role assignment scope for a dynamic service principal or the object ID of
+// an existing application.
+type azureIdentity struct {
+	SubscriptionID      string
+	ResourceGroup       string
+	ApplicationObjectID string
+}
+
+// Azure provides configuration when creating a new Operator
+type Azure struct {
+	DefaultTTL time.Duration
+	Path       string
+	Rules      AzureRules
+	tmpl       *template.Template
+
+	// mu guards the rules, ttl settings and policy template, which are
+	// replaced when the config file or the AzureAccessRule resources change
+	mu            sync.RWMutex
+	resourceRules AzureRules
+}
+
+// NewAzureProvider returns a configured Azure provider config
+func NewAzureProvider(config azureFileConfig) (*Azure, error) {
+	tmpl, err := parseProviderPolicyTemplate(azurePolicyTemplate, config.PolicyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Azure{
+		tmpl: tmpl,
+
+		DefaultTTL: config.DefaultTTL,
+		Path:       config.Path,
+		Rules:      config.Rules,
+	}, nil
+}
+
+// name returns the name of the Azure provider
+func (az *Azure) name() string {
+	return "azure"
+}
+
+func (az *Azure) secretIdentityAnnotation() string {
+	return azureRoleAnnotation
+}
+
+func (az *Azure) secretPath(_ string) string {
+	return az.Path + "/roles/"
+}
+
+func (az *Azure) secretPaths() []string {
+	return []string{az.Path + "/roles/"}
+}
+
+// vaultNamespaces returns the distinct vault namespaces set by the rules
+func (az *Azure) vaultNamespaces() []string {
+	var vaultNamespaces []string
+	for _, r := range az.rules() {
+		if r.VaultNamespace != "" && !slices.Contains(vaultNamespaces, r.VaultNamespace) {
+			vaultNamespaces = append(vaultNamespaces, r.VaultNamespace)
+		}
+	}
+
+	return vaultNamespaces
+}
+
+func (az *Azure) processUpdateEvent(e event.UpdateEvent) bool {
+	return e.ObjectOld.GetAnnotations()[azureRoleAnnotation] != e.ObjectNew.GetAnnotations()[azureRoleAnnotation] ||
+		e.ObjectOld.GetAnnotations()[azureRoleNameAnnotation] != e.ObjectNew.GetAnnotations()[azureRoleNameAnnotation] ||
+		e.ObjectOld.GetAnnotations()[defaultAzureTTLAnnotation] != e.ObjectNew.GetAnnotations()[defaultAzureTTLAnnotation]
+}
+
+// updateConfig replaces the rules, ttl settings and policy template with those
+// in the provided config
+func (az *Azure) updateConfig(fc *fileConfig) {
+	// The template has been validated when the config was loaded
+	tmpl, err := parseProviderPolicyTemplate(azurePolicyTemplate, fc.Azure.PolicyTemplate)
+	if err != nil {
+		log.Error(err, "error parsing policy template, keeping the current one", "provider", az.name())
+	}
+
+	az.mu.Lock()
+	defer az.mu.Unlock()
+
+	if tmpl != nil {
+		az.tmpl = tmpl
+	}
+	az.DefaultTTL = fc.Azure.DefaultTTL
+	az.Rules = fc.Azure.Rules
+}
+
+// secretTTL returns the ttl in the default-azure-ttl annotation of the service
+// account, or the default ttl. Azure rules don't have ttl settings.
+func (az *Azure) secretTTL(serviceAccount *corev1.ServiceAccount, _ matchedRule) (time.Duration, error) {
+	az.mu.RLock()
+	bounds := ttlBounds{defaultTTL: az.DefaultTTL}
+	az.mu.RUnlock()
+
+	return bounds.secretTTL(serviceAccount, defaultAzureTTLAnnotation)
+}
+
+func (az *Azure) secretPayload(serviceAccount *corev1.ServiceAccount, secretTTL time.Duration) (map[string]interface{}, error) {
+	identity := serviceAccount.Annotations[azureRoleAnnotation]
+	id, err := parseAzureIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	// An existing application is used as is, otherwise vault creates a
+	// dynamic service principal with a role assignment at the given scope
+	if id.ApplicationObjectID != "" {
+		return map[string]interface{}{
+			"application_object_id": id.ApplicationObjectID,
+			"ttl":                   int(secretTTL.Seconds()),
+		}, nil
+	}
+
+	azureRoles, err := json.Marshal([]map[string]string{
+		{
+			"role_name": azureRoleName(serviceAccount),
+			"scope":     identity,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"azure_roles": string(azureRoles),
+		"ttl":         int(secretTTL.Seconds()),
+	}, nil
+}
+
+// renderPolicyTemplate injects the provided name into a policy allowing access
+// to the corresponding Azure secret role
+func (az *Azure) renderPolicyTemplate(name string, serviceAccount *corev1.ServiceAccount, _ matchedRule) (string, error) {
+	az.mu.RLock()
+	tmpl := az.tmpl
+	az.mu.RUnlock()
+
+	return renderPolicy(tmpl, policyTemplateData{
+		Namespace:      serviceAccount.Namespace,
+		ServiceAccount: serviceAccount.Name,
+		Name:           name,
+		Path:           az.Path,
+	})
+}
+
+// rules returns the rules from the config file followed by the rules from
+// AzureAccessRule resources
+func (az *Azure) rules() AzureRules {
+	az.mu.RLock()
+	defer az.mu.RUnlock()
+
+	return append(az.Rules[:len(az.Rules):len(az.Rules)], az.resourceRules...)
+}
+
+// hasRules returns true if there are rules in the config file or from
+// AzureAccessRule resources
+func (az *Azure) hasRules() bool {
+	return len(az.rules()) > 0
+}
+
+func (az *Azure) selectsNamespaces() bool {
+	return false
+}
+
+// matchRule ignores the namespace labels, since Azure rules don't have
+// namespace selectors
+func (az *Azure) matchRule(serviceAccount *corev1.ServiceAccount, _ map[string]string) (matchedRule, error) {
+	return az.rules().matchRule(serviceAccount)
+}
+
+// allow returns true if there is a rule in the list of rules which allows
+// the service account to use the identity in its annotation. Rules are
+// evaluated in order and allow returns true for the first matching rule in the
+// list
+func (azr AzureRules) allow(serviceAccount *corev1.ServiceAccount) (bool, error) {
+	i, err := azr.match(serviceAccount)
+	if err != nil {
+		return false, err
+	}
+
+	if i >= 0 || len(azr) > 0 {
+		return i >= 0, nil
+	}
+
+	// Without rules there aren't patterns to allow extra policies, and
+	// only the default role can be assigned
+	id, err := parseAzureIdentity(serviceAccount.Annotations[azureRoleAnnotation])
+	if err != nil {
+		return false, err
+	}
+	if err := (&AzureRule{}).checkRoleName(serviceAccount, id); err != nil {
+		return false, err
+	}
+	if err := checkExtraPolicies(serviceAccount, nil); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// match returns the index of the first rule in the list which allows the
+// service account to use the identity in its annotation, or -1 if none of them
+// do
+func (azr AzureRules) match(serviceAccount *corev1.ServiceAccount) (int, error) {
+	id, err := parseAzureIdentity(serviceAccount.Annotations[azureRoleAnnotation])
+	if err != nil {
+		return -1, err
+	}
+
+	for i, r := range azr {
+		allowed, err := r.allows(serviceAccount.Namespace, id)
+		if err != nil {
+			return -1, err
+		}
+		if allowed {
+			// The rule that allows the identity decides the role
+			// names and the extra policies
+			if err := r.checkRoleName(serviceAccount, id); err != nil {
+				return -1, err
+			}
+			if err := checkExtraPolicies(serviceAccount, r.AllowedExtraPolicies); err != nil {
+				return -1, err
+			}
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// matchRule returns the first rule in the list which allows the service
+// account to use the identity in its annotation. Azure rules don't have
+// identity templates, so the identity can't be auto.
+func (azr AzureRules) matchRule(serviceAccount *corev1.ServiceAccount) (matchedRule, error) {
+	rule := matchedRule{index: -1, identity: serviceAccount.Annotations[azureRoleAnnotation]}
+	if rule.identity == autoIdentity {
+		return rule, fmt.Errorf("%s can't be %s, azure rules don't have templates", azureRoleAnnotation, autoIdentity)
+	}
+
+	i, err := azr.match(serviceAccount)
+	if err != nil {
+		return rule, err
+	}
+	if i < 0 {
+		rule.allowed, err = azr.allow(serviceAccount)
+		return rule, err
+	}
+
+	rule.index = i
+	rule.allowed = true
+	rule.vaultNamespace = azr[i].VaultNamespace
+
+	return rule, nil
+}
+
+// parseAzureIdentity parses the value of the azure-role annotation, which is
+// either a scope in the form /subscriptions/<id>[/resourceGroups/<name>] or
+// the object ID of an existing application
+func parseAzureIdentity(identity string) (*azureIdentity, error) {
+	if azureObjectIDRegex.MatchString(identity) {
+		return &azureIdentity{ApplicationObjectID: strings.ToLower(identity)}, nil
+	}
+
+	if !strings.HasPrefix(identity, azureScopeSubscriptionPrefix) {
+		return nil, fmt.Errorf("invalid azure identity, must be a scope or an application object id: %s", identity)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(identity, azureScopeSubscriptionPrefix), "/")
+	switch {
+	case len(parts) == 1 && azureObjectIDRegex.MatchString(parts[0]):
+		return &azureIdentity{SubscriptionID: strings.ToLower(parts[0])}, nil
+	case len(parts) == 3 && azureObjectIDRegex.MatchString(parts[0]) && strings.EqualFold(parts[1], "resourceGroups") && parts[2] != "":
+		return &azureIdentity{SubscriptionID: strings.ToLower(parts[0]), ResourceGroup: parts[2]}, nil
+	default:
+		return nil, fmt.Errorf("invalid azure scope, must be /subscriptions/<id>[/resourceGroups/<name>]: %s", identity)
+	}
+}
+
+// validate checks that the patterns of the rule are valid and that the
+// subscription and application object IDs are in the form of IDs
+func (azr *AzureRule) validate() error {
+	for _, field := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"namespacePatterns", azr.NamespacePatterns},
+		{"resourceGroupPatterns", azr.ResourceGroupPatterns},
+	} {
+		for _, p := range field.patterns {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern in %s: %s: %w", field.name, p, err)
+			}
+		}
+	}
+	for _, field := range []struct {
+		name string
+		ids  []string
+	}{
+		{"subscriptionIDs", azr.SubscriptionIDs},
+		{"applicationObjectIDs", azr.ApplicationObjectIDs},
+	} {
+		for _, id := range field.ids {
+			if !azureObjectIDRegex.MatchString(id) {
+				return fmt.Errorf("invalid id in %s: %s", field.name, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// allows checks whether this rule allows a namespace to use the given identity
+func (azr *AzureRule) allows(namespace string, id *azureIdentity) (bool, error) {
+	namespaceAllowed, err := matchesNamespace(namespace, azr.NamespacePatterns)
+	if err != nil {
+		return false, err
+	}
+
+	if id.ApplicationObjectID != "" {
+		return namespaceAllowed && azr.matchesApplicationObjectID(id.ApplicationObjectID), nil
+	}
+
+	// A subscription wide scope is only granted by rules that explicitly
+	// list the subscription and don't narrow it down to resource groups
+	if id.ResourceGroup == "" {
+		subscriptionAllowed := len(azr.ResourceGroupPatterns) == 0 &&
+			len(azr.SubscriptionIDs) > 0 &&
+			azr.matchesSubscriptionID(id.SubscriptionID)
+
+		return namespaceAllowed && subscriptionAllowed, nil
+	}
+
+	resourceGroupAllowed, err := azr.matchesResourceGroup(id.ResourceGroup)
+	if err != nil {
+		return false, err
+	}
+
+	return namespaceAllowed && azr.matchesSubscriptionID(id.SubscriptionID) && resourceGroupAllowed, nil
+}
+
+// checkRoleName returns an error naming the role in the azure-role-name
+// annotation if the rule doesn't allow it to be assigned. The role only
+// applies to scopes, since existing applications are used as they are.
+func (azr *AzureRule) checkRoleName(serviceAccount *corev1.ServiceAccount, id *azureIdentity) error {
+	if id.ApplicationObjectID != "" {
+		return nil
+	}
+
+	allowedRoleNames := azr.AllowedRoleNames
+	if len(allowedRoleNames) == 0 {
+		allowedRoleNames = []string{defaultAzureRoleName}
+	}
+	roleName := azureRoleName(serviceAccount)
+	if slices.ContainsFunc(allowedRoleNames, func(n string) bool { return strings.EqualFold(n, roleName) }) {
+		return nil
+	}
+
+	return fmt.Errorf("azure role name %s isn't allowed, the allowed role names are %s", roleName, strings.Join(allowedRoleNames, ","))
+}
+
+// azureRoleName returns the role in the azure-role-name annotation of the
+// service account, or the default role
+func azureRoleName(serviceAccount *corev1.ServiceAccount) string {
+	if roleName := serviceAccount.Annotations[azureRoleNameAnnotation]; roleName != "" {
+		return roleName
+	}
+
+	return defaultAzureRoleName
+}
+
+// matchesSubscriptionID returns true if the rule allows a subscription, or if
+// it doesn't contain a subscription at all
+func (azr *AzureRule) matchesSubscriptionID(subscriptionID string) bool {
+	for _, id := range azr.SubscriptionIDs {
+		if strings.EqualFold(id, subscriptionID) {
+			return true
+		}
+	}
+
+	return len(azr.SubscriptionIDs) == 0
+}
+
+// matchesResourceGroup returns true if the rule allows the given resource
+// group
+func (azr *AzureRule) matchesResourceGroup(resourceGroup string) (bool, error) {
+	for _, rp := range azr.ResourceGroupPatterns {
+		match, err := filepath.Match(rp, resourceGroup)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchesApplicationObjectID returns true if the rule allows the given
+// application object ID
+func (azr *AzureRule) matchesApplicationObjectID(applicationObjectID string) bool {
+	for _, id := range azr.ApplicationObjectIDs {
+		if strings.EqualFold(id, applicationObjectID) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,178 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// TestAzureOperatorAdmitEvent tests that events are allowed and disallowed
+// according to the rules
+func TestAzureOperatorAdmitEvent(t *testing.T) {
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	fc := &fileConfig{}
+	config := &Config{}
+	azure, _ := NewAzureProvider(fc.Azure)
+	o, _ := NewOperator(config, azure)
+
+	// Test that without any rules any valid event is admitted
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo")))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "11111111-1111-1111-1111-111111111111")))
+
+	// Test that an empty identity is not admitted
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "")))
+
+	// Test that an invalid identity is not admitted
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "foobar")))
+
+	// Test that a malformed scope is not admitted
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "/subscriptions/foo/resourceGroups/bar")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo/providers/bar")))
+
+	azure.Rules = AzureRules{
+		AzureRule{
+			NamespacePatterns: []string{
+				"foo",
+				"bar-*",
+			},
+			SubscriptionIDs: []string{
+				"00000000-0000-0000-0000-000000000000",
+			},
+			ResourceGroupPatterns: []string{
+				"foo-*",
+			},
+		},
+		AzureRule{
+			NamespacePatterns: []string{
+				"kube-system",
+			},
+			SubscriptionIDs: []string{
+				"00000000-0000-0000-0000-000000000000",
+			},
+			ApplicationObjectIDs: []string{
+				"11111111-1111-1111-1111-111111111111",
+			},
+		},
+		AzureRule{
+			ResourceGroupPatterns: []string{
+				"baz",
+			},
+		},
+		AzureRule{
+			NamespacePatterns: []string{
+				"foobar",
+			},
+		},
+	}
+
+	// Test bar-* : foo-* is allowed
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar-foo", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo-bar")))
+
+	// Test that the subscription id is matched case insensitively
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/foo-bar")))
+
+	// Test the second rule is evaluated
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", azureRoleAnnotation, "11111111-1111-1111-1111-111111111111")))
+
+	// Test the second rule allows the subscription scope
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000")))
+
+	// Test that a subscription outside of the list is not allowed
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", azureRoleAnnotation, "/subscriptions/22222222-2222-2222-2222-222222222222/resourceGroups/foo-bar")))
+
+	// Test that a rule with resource group patterns does not admit the
+	// whole subscription
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000")))
+
+	// Test that the rules don't mix
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", azureRoleAnnotation, "11111111-1111-1111-1111-111111111111")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("kube-system", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo-bar")))
+
+	// Test that a rule without a namespace pattern does not admit
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/baz")))
+
+	// Test that a rule without any identity does not admit
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "/subscriptions/00000000-0000-0000-0000-000000000000")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", azureRoleAnnotation, "11111111-1111-1111-1111-111111111111")))
+}
+
+// TestAzureOperatorAdmitEventRoleNames tests that only the roles that a rule
+// allows can be assigned, and only Reader when it doesn't list any
+func TestAzureOperatorAdmitEventRoleNames(t *testing.T) {
+	azure, _ := NewAzureProvider(defaultFileConfig.Azure)
+	o, _ := NewOperator(&Config{}, azure)
+
+	scope := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo-bar"
+
+	// Test that without rules only the default role can be assigned
+	serviceAccount := annotatedServiceAccount("foo", azureRoleAnnotation, scope)
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Annotations[azureRoleNameAnnotation] = "Owner"
+	assert.False(t, o.admitEvent(serviceAccount))
+
+	azure.Rules = AzureRules{
+		AzureRule{
+			NamespacePatterns:     []string{"foo"},
+			ResourceGroupPatterns: []string{"foo-*"},
+		},
+		AzureRule{
+			NamespacePatterns:     []string{"bar"},
+			ResourceGroupPatterns: []string{"foo-*"},
+			AllowedRoleNames:      []string{"Reader", "Contributor"},
+		},
+	}
+
+	// Test that a rule without allowed role names only allows Reader
+	serviceAccount = annotatedServiceAccount("foo", azureRoleAnnotation, scope)
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Annotations[azureRoleNameAnnotation] = "reader"
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Annotations[azureRoleNameAnnotation] = "Owner"
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/azure-role "+scope+" was denied by azure.rules: azure role name Owner isn't allowed, the allowed role names are Reader", o.deniedReason(serviceAccount))
+
+	// Test that the allowed role names of the rule apply
+	serviceAccount = annotatedServiceAccount("bar", azureRoleAnnotation, scope)
+	serviceAccount.Annotations[azureRoleNameAnnotation] = "Contributor"
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Annotations[azureRoleNameAnnotation] = "Owner"
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/azure-role "+scope+" was denied by azure.rules: azure role name Owner isn't allowed, the allowed role names are Reader,Contributor", o.deniedReason(serviceAccount))
+}
+
+func TestAzureSecretPayload(t *testing.T) {
+	azure, _ := NewAzureProvider(defaultFileConfig.Azure)
+
+	payload, err := azure.secretPayload(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				azureRoleAnnotation: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo",
+			},
+		},
+	}, 30*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"azure_roles": `[{"role_name":"Reader","scope":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/foo"}]`,
+		"ttl":         1800,
+	}, payload)
+
+	payload, err = azure.secretPayload(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				azureRoleAnnotation: "11111111-1111-1111-1111-111111111111",
+			},
+		},
+	}, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"application_object_id": "11111111-1111-1111-1111-111111111111",
+		"ttl":                   3600,
+	}, payload)
+}
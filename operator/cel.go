@@ -0,0 +1,197 @@
+package operator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// celVariables are the variables available to rule expressions, in addition
+// to serviceAccount, for each provider. The namespace is a field of
+// serviceAccount because namespace is a reserved word in CEL.
+var celVariables = map[string][]cel.EnvOption{
+	"aws": {
+		cel.Variable("arn", cel.MapType(cel.StringType, cel.StringType)),
+	},
+	"gcp": {
+		cel.Variable("email", cel.StringType),
+		cel.Variable("project", cel.StringType),
+	},
+}
+
+// maxCELPrograms is the number of compiled expressions that are cached before
+// the cache is cleared. Expressions that aren't used anymore, such as those of
+// access rules that have been changed, would otherwise be kept forever.
+const maxCELPrograms = 1000
+
+// celCostLimit is the cost that evaluating an expression can't exceed, so that
+// an expression in an access rule can't hold up the evaluation of the rules.
+// It's far more than the cost of comparing the fields of a service account.
+const celCostLimit = 100000
+
+// celProgram is a compiled rule expression
+type celProgram struct {
+	cel.Program
+	// errorLogged is whether an error evaluating the expression has been
+	// logged since the rules were last loaded
+	errorLogged bool
+}
+
+var (
+	// celPrograms caches the compiled rule expressions by provider and
+	// expression. Keeping the programs out of the rules means that rules
+	// can still be compared and copied as plain data.
+	celMu       sync.Mutex
+	celPrograms = map[string]*celProgram{}
+)
+
+// compileExpression compiles a rule expression for the given provider, which
+// must evaluate to a bool
+func compileExpression(provider, expression string) (*celProgram, error) {
+	key := provider + "/" + expression
+
+	celMu.Lock()
+	defer celMu.Unlock()
+
+	if prg, ok := celPrograms[key]; ok {
+		return prg, nil
+	}
+
+	vars, ok := celVariables[provider]
+	if !ok {
+		return nil, fmt.Errorf("expressions aren't supported for the %s provider", provider)
+	}
+
+	env, err := cel.NewEnv(append([]cel.EnvOption{
+		ext.Strings(),
+		cel.Variable("serviceAccount", cel.MapType(cel.StringType, cel.DynType)),
+	}, vars...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) {
+		return nil, fmt.Errorf("expression must evaluate to a bool, not %s", ast.OutputType())
+	}
+
+	program, err := env.Program(ast, cel.CostLimit(celCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	if len(celPrograms) >= maxCELPrograms {
+		celPrograms = map[string]*celProgram{}
+	}
+	prg := &celProgram{Program: program}
+	celPrograms[key] = prg
+
+	return prg, nil
+}
+
+// resetExpressionErrors is called when the rules are loaded, so that errors
+// evaluating their expressions are logged again
+func resetExpressionErrors() {
+	celMu.Lock()
+	defer celMu.Unlock()
+
+	for _, prg := range celPrograms {
+		prg.errorLogged = false
+	}
+}
+
+// logExpressionError logs an error evaluating an expression, once for each
+// time the rules are loaded rather than for every service account that it's
+// evaluated for
+func logExpressionError(prg *celProgram, err error, provider, expression string, serviceAccount *corev1.ServiceAccount) {
+	celMu.Lock()
+	logged := prg.errorLogged
+	prg.errorLogged = true
+	celMu.Unlock()
+
+	if !logged {
+		log.Error(err, "error evaluating expression, the rule doesn't match", "provider", provider, "expression", expression, "namespace", serviceAccount.Namespace, "serviceaccount", serviceAccount.Name)
+	}
+}
+
+// evalExpression evaluates a rule expression for the given provider with the
+// service account and the provider specific variables. An error at runtime,
+// such as a missing label, is logged and the expression doesn't match, so that
+// it doesn't stop the rules after it from being evaluated. So is an expression
+// that exceeds the cost limit.
+func evalExpression(provider, expression string, serviceAccount *corev1.ServiceAccount, vars map[string]interface{}) (bool, error) {
+	prg, err := compileExpression(provider, expression)
+	if err != nil {
+		return false, err
+	}
+
+	activation := map[string]interface{}{
+		"serviceAccount": map[string]interface{}{
+			"namespace":   serviceAccount.Namespace,
+			"name":        serviceAccount.Name,
+			"labels":      nonNilMap(serviceAccount.Labels),
+			"annotations": nonNilMap(serviceAccount.Annotations),
+		},
+	}
+	for k, v := range vars {
+		activation[k] = v
+	}
+
+	out, _, err := prg.Eval(activation)
+	if err != nil {
+		logExpressionError(prg, err, provider, expression, serviceAccount)
+		return false, nil
+	}
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		logExpressionError(prg, fmt.Errorf("expression evaluated to %v rather than a bool", out.Value()), provider, expression, serviceAccount)
+		return false, nil
+	}
+
+	return allowed, nil
+}
+
+// awsExpressionVars returns the parts of a role arn that are available to
+// expressions. The path and role name are split as in IAM, so the role
+// arn:aws:iam::000000000000:role/foo/bar has the path /foo/ and the name bar.
+func awsExpressionVars(roleArn arn.ARN) map[string]interface{} {
+	resource := strings.TrimPrefix(roleArn.Resource, "role/")
+	path, roleName := "/", resource
+	if i := strings.LastIndex(resource, "/"); i >= 0 {
+		path, roleName = "/"+resource[:i+1], resource[i+1:]
+	}
+
+	return map[string]interface{}{
+		"arn": map[string]string{
+			"partition": roleArn.Partition,
+			"service":   roleArn.Service,
+			"account":   roleArn.AccountID,
+			"path":      path,
+			"roleName":  roleName,
+		},
+	}
+}
+
+// gcpExpressionVars returns the email of a GCP service account and the project
+// it belongs to
+func gcpExpressionVars(serviceAccountEmail string) map[string]interface{} {
+	return map[string]interface{}{
+		"email":   serviceAccountEmail,
+		"project": gcpProject(serviceAccountEmail),
+	}
+}
+
+func nonNilMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+
+	return m
+}
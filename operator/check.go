@@ -0,0 +1,398 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CheckResult is the outcome of evaluating the annotation of a service account
+// for a provider against the rules in the config file, along with the objects
+// that the operator would write to vault for it
+type CheckResult struct {
+	Provider       string
+	Namespace      string
+	ServiceAccount string
+	Identity       string
+	Allowed        bool
+	// Rule is the index of the matching rule in the rules of the
+	// provider, or -1 if no rule matched
+	Rule int
+	// Unevaluated is true if the rules couldn't be evaluated with the
+	// objects in the manifests, Reason says why
+	Unevaluated bool
+	Reason      string
+	Key         string
+	TTL         time.Duration
+	Policy      string
+	// Policies are the policies of the kubernetes auth role
+	Policies []string
+	// VaultNamespace is the vault namespace set by the matching rule
+	VaultNamespace string
+	Payload        map[string]interface{}
+	Error          error
+}
+
+// OK returns true if the service account is allowed and the objects for it
+// could be computed
+func (cr *CheckResult) OK() bool {
+	return cr.Allowed && cr.Error == nil
+}
+
+// String formats the result for humans
+func (cr *CheckResult) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s/%s (%s)\n", cr.Namespace, cr.ServiceAccount, cr.Provider)
+	fmt.Fprintf(&b, "  identity: %s\n", cr.Identity)
+	switch {
+	case cr.Allowed && cr.Rule >= 0:
+		fmt.Fprintf(&b, "  allowed:  true (%s.rules[%d])\n", cr.Provider, cr.Rule)
+	case cr.Allowed:
+		fmt.Fprintf(&b, "  allowed:  true (no %s.rules)\n", cr.Provider)
+	case cr.Unevaluated:
+		fmt.Fprintf(&b, "  allowed:  unknown (%s)\n", cr.Reason)
+		return b.String()
+	default:
+		fmt.Fprintf(&b, "  allowed:  false (%s)\n", cr.Reason)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  key:      %s\n", cr.Key)
+	if cr.VaultNamespace != "" {
+		fmt.Fprintf(&b, "  vault ns: %s\n", cr.VaultNamespace)
+	}
+	if cr.Error != nil {
+		fmt.Fprintf(&b, "  error:    %s\n", cr.Error)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  ttl:      %s\n", cr.TTL)
+	fmt.Fprintf(&b, "  policies: %s\n", strings.Join(cr.Policies, ", "))
+	fmt.Fprintf(&b, "  policy:\n%s", indent(strings.TrimSpace(cr.Policy), "    "))
+	payload, err := json.MarshalIndent(cr.Payload, "", "  ")
+	if err != nil {
+		fmt.Fprintf(&b, "  payload:  %v\n", cr.Payload)
+	} else {
+		fmt.Fprintf(&b, "  payload:\n%s", indent(string(payload), "    "))
+	}
+
+	return b.String()
+}
+
+func indent(s, prefix string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+
+	return b.String()
+}
+
+// Manifests are the objects read from manifests that are checked: the service
+// accounts, the namespaces that have the labels for the namespace selectors of
+// the rules, and the access rule resources, which stand in for the ones in the
+// cluster when they're watched
+type Manifests struct {
+	ServiceAccounts  []*corev1.ServiceAccount
+	Namespaces       []*corev1.Namespace
+	AWSAccessRules   []AWSAccessRule
+	GCPAccessRules   []GCPAccessRule
+	AzureAccessRules []AzureAccessRule
+}
+
+// hasAccessRules returns true if there are access rule resources for the
+// provider in the manifests
+func (m *Manifests) hasAccessRules(provider string) bool {
+	switch provider {
+	case "aws":
+		return len(m.AWSAccessRules) > 0
+	case "gcp":
+		return len(m.GCPAccessRules) > 0
+	case "azure":
+		return len(m.AzureAccessRules) > 0
+	default:
+		return false
+	}
+}
+
+// manifestReader lists the access rule resources in the manifests, so that
+// they can be loaded by the providers as they are from the cluster
+type manifestReader struct {
+	*Manifests
+}
+
+func (mr manifestReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	return fmt.Errorf("can't get %T from manifests", obj)
+}
+
+func (mr manifestReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	switch l := list.(type) {
+	case *AWSAccessRuleList:
+		l.Items = mr.AWSAccessRules
+	case *GCPAccessRuleList:
+		l.Items = mr.GCPAccessRules
+	case *AzureAccessRuleList:
+		l.Items = mr.AzureAccessRules
+	default:
+		return fmt.Errorf("can't list %T from manifests", list)
+	}
+
+	return nil
+}
+
+// Check evaluates the service accounts in the manifests against the rules in
+// the provided config file for each of the given providers, or for the
+// providers in the config file if none are given. Service accounts that aren't
+// annotated for a provider are skipped. Kubernetes and vault aren't contacted,
+// so when access rule resources are watched they're taken from the manifests,
+// and service accounts are unevaluated if there are none for the provider. The
+// labels of namespaces are taken from the manifests too, and service accounts
+// in other namespaces are unevaluated if the rules have namespace selectors.
+func Check(configFile string, providers []string, manifests *Manifests) ([]CheckResult, error) {
+	fc, err := loadConfigFromFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(providers) == 0 {
+		providers = fc.Providers
+	}
+
+	namespaces := map[string]*corev1.Namespace{}
+	for _, namespace := range manifests.Namespaces {
+		namespaces[namespace.Name] = namespace
+	}
+
+	var results []CheckResult
+	for _, name := range providers {
+		p, err := newProvider(name, fc)
+		if err != nil {
+			return nil, err
+		}
+
+		o, err := NewOperator(&Config{
+			KubernetesAuthBackend: fc.KubernetesAuthBackend,
+			Prefix:                fc.Prefix,
+			WatchAccessRules:      fc.WatchAccessRules,
+		}, p)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without the access rule resources, a service account that
+		// the rules in the config file allow may be denied by the
+		// operator, or the other way around
+		accessRulesUnknown := fc.WatchAccessRules && !manifests.hasAccessRules(name)
+		if fc.WatchAccessRules && !accessRulesUnknown {
+			if err := p.loadAccessRules(context.Background(), manifestReader{manifests}); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, serviceAccount := range manifests.ServiceAccounts {
+			if serviceAccount.Annotations[p.secretIdentityAnnotation()] == "" {
+				continue
+			}
+			if accessRulesUnknown {
+				results = append(results, CheckResult{
+					Provider:       name,
+					Namespace:      serviceAccount.Namespace,
+					ServiceAccount: serviceAccount.Name,
+					Identity:       serviceAccount.Annotations[p.secretIdentityAnnotation()],
+					Rule:           -1,
+					Unevaluated:    true,
+					Reason:         "unevaluated: access rules are watched",
+				})
+				continue
+			}
+			results = append(results, o.check(serviceAccount, namespaces[serviceAccount.Namespace]))
+		}
+	}
+
+	return results, nil
+}
+
+// check evaluates a service account against the rules and computes the objects
+// that would be written to vault for it. The namespace is nil if it isn't in
+// the manifests.
+func (o *Operator) check(serviceAccount *corev1.ServiceAccount, namespace *corev1.Namespace) CheckResult {
+	cr := CheckResult{
+		Provider:       o.provider.name(),
+		Namespace:      serviceAccount.Namespace,
+		ServiceAccount: serviceAccount.Name,
+		Identity:       serviceAccount.Annotations[o.provider.secretIdentityAnnotation()],
+		Rule:           -1,
+	}
+
+	// When access rules are watched, no rules admit nothing
+	if o.WatchAccessRules && !o.provider.hasRules() {
+		cr.Reason = o.deniedReason(serviceAccount)
+		return cr
+	}
+
+	// There isn't a cluster to read the namespace labels from, so they're
+	// taken from the manifests. Matching the selectors against no labels
+	// could deny, or allow, a service account that the operator wouldn't.
+	var namespaceLabels map[string]string
+	switch {
+	case namespace != nil:
+		namespaceLabels = namespace.Labels
+	case o.provider.selectsNamespaces():
+		cr.Unevaluated = true
+		cr.Reason = "namespace labels not provided"
+		return cr
+	}
+
+	rule, err := o.matchServiceAccount(serviceAccount, namespaceLabels)
+	cr.Rule = rule.index
+	cr.Allowed = err == nil && rule.allowed
+	if !cr.Allowed {
+		cr.Reason = o.deniedReasonWithLabels(serviceAccount, namespaceLabels, nil)
+		return cr
+	}
+
+	cr.Key = o.name(cr.Namespace, cr.ServiceAccount)
+	resolved := o.resolveIdentity(serviceAccount, rule)
+	cr.Identity = resolved.Annotations[o.provider.secretIdentityAnnotation()]
+	if cr.TTL, cr.Error = o.provider.secretTTL(serviceAccount, rule); cr.Error != nil {
+		return cr
+	}
+	if cr.Policy, cr.Error = o.provider.renderPolicyTemplate(cr.Key, resolved, rule); cr.Error != nil {
+		return cr
+	}
+	cr.Policies = rolePolicies(cr.Key, resolved)
+	cr.VaultNamespace = rule.vaultNamespace
+	cr.Payload, cr.Error = o.provider.secretPayload(resolved, cr.TTL)
+
+	return cr
+}
+
+// NewCheckServiceAccount returns a service account annotated with the given
+// identity for the provider, so that a namespace and identity can be checked
+// without a manifest
+func NewCheckServiceAccount(providerName, namespace, name, identity string) (*corev1.ServiceAccount, error) {
+	p, err := newProvider(providerName, defaultFileConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				p.secretIdentityAnnotation(): identity,
+			},
+		},
+	}, nil
+}
+
+// Read adds the service accounts, namespaces and access rule resources from a
+// stream of yaml or json manifests. Other kinds of objects are skipped and service
+// accounts without a namespace are in the default namespace.
+func (m *Manifests) Read(r io.Reader) error {
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if err := m.decode(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// decode adds the objects in a manifest
+func (m *Manifests) decode(raw json.RawMessage) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return err
+	}
+
+	switch typeMeta.Kind {
+	case "ServiceAccount":
+		serviceAccount := &corev1.ServiceAccount{}
+		if err := json.Unmarshal(raw, serviceAccount); err != nil {
+			return err
+		}
+		if serviceAccount.Namespace == "" {
+			serviceAccount.Namespace = metav1.NamespaceDefault
+		}
+		m.ServiceAccounts = append(m.ServiceAccounts, serviceAccount)
+	case "Namespace":
+		namespace := &corev1.Namespace{}
+		if err := json.Unmarshal(raw, namespace); err != nil {
+			return err
+		}
+		m.Namespaces = append(m.Namespaces, namespace)
+	case "AWSAccessRule":
+		accessRule := AWSAccessRule{}
+		if err := json.Unmarshal(raw, &accessRule); err != nil {
+			return err
+		}
+		m.AWSAccessRules = append(m.AWSAccessRules, accessRule)
+	case "GCPAccessRule":
+		accessRule := GCPAccessRule{}
+		if err := json.Unmarshal(raw, &accessRule); err != nil {
+			return err
+		}
+		m.GCPAccessRules = append(m.GCPAccessRules, accessRule)
+	case "AzureAccessRule":
+		accessRule := AzureAccessRule{}
+		if err := json.Unmarshal(raw, &accessRule); err != nil {
+			return err
+		}
+		m.AzureAccessRules = append(m.AzureAccessRules, accessRule)
+	case "List", "ServiceAccountList", "NamespaceList", "AWSAccessRuleList", "GCPAccessRuleList", "AzureAccessRuleList":
+		// The kind of the items is set in a List, but may not be in
+		// the lists of a kind
+		itemKind := strings.TrimSuffix(typeMeta.Kind, "List")
+		list := struct {
+			Items []json.RawMessage `json:"items"`
+		}{}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if itemKind != "" {
+				var err error
+				if item, err = withKind(item, itemKind); err != nil {
+					return err
+				}
+			}
+			if err := m.decode(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// withKind sets the kind of an object in a manifest
+func withKind(raw json.RawMessage, kind string) (json.RawMessage, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	obj["kind"] = kind
+
+	return json.Marshal(obj)
+}
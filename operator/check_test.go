@@ -0,0 +1,257 @@
+package operator
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestManifestsRead(t *testing.T) {
+	manifests := &Manifests{}
+	err := manifests.Read(strings.NewReader(`
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: foo
+  namespace: bar
+  annotations:
+    vault.uw.systems/aws-role: arn:aws:iam::111111111111:role/foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: ServiceAccount
+    metadata:
+      name: baz
+---
+apiVersion: vault.uw.systems/v1alpha1
+kind: AWSAccessRule
+metadata:
+  name: foo
+spec:
+  namespacePatterns:
+    - foo
+  roleNamePatterns:
+    - foo
+---
+apiVersion: vault.uw.systems/v1alpha1
+kind: GCPAccessRuleList
+items:
+  - metadata:
+      name: bar
+    spec:
+      namespacePatterns:
+        - bar
+`))
+	require.NoError(t, err)
+	serviceAccounts := manifests.ServiceAccounts
+	require.Len(t, serviceAccounts, 2)
+
+	assert.Equal(t, "bar", serviceAccounts[0].Namespace)
+	assert.Equal(t, "foo", serviceAccounts[0].Name)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/foo", serviceAccounts[0].Annotations[awsRoleAnnotation])
+
+	// Test that service accounts without a namespace are in the default
+	// namespace
+	assert.Equal(t, "default", serviceAccounts[1].Namespace)
+	assert.Equal(t, "baz", serviceAccounts[1].Name)
+
+	// Test that access rules are read, including the items of a list
+	// without a kind
+	require.Len(t, manifests.AWSAccessRules, 1)
+	assert.Equal(t, "foo", manifests.AWSAccessRules[0].Name)
+	assert.Equal(t, []string{"foo"}, manifests.AWSAccessRules[0].Spec.RoleNamePatterns)
+	require.Len(t, manifests.GCPAccessRules, 1)
+	assert.Equal(t, "bar", manifests.GCPAccessRules[0].Name)
+	assert.Equal(t, []string{"bar"}, manifests.GCPAccessRules[0].Spec.NamespacePatterns)
+}
+
+// TestCheck tests that service accounts are evaluated against the rules in the
+// config file and the objects that would be written to vault are computed
+func TestCheck(t *testing.T) {
+	tmpConf, err := os.CreateTemp("", "vault-kube-cloud-test-*")
+	require.NoError(t, err)
+	defer os.Remove(tmpConf.Name())
+	_, err = tmpConf.WriteString(`
+providers:
+  - aws
+  - gcp
+aws:
+  rules:
+    - namespacePatterns:
+        - bar
+      roleNamePatterns:
+        - bar
+    - namespacePatterns:
+        - foo
+      roleNamePatterns:
+        - foo
+`)
+	require.NoError(t, err)
+	tmpConf.Close()
+
+	allowed, _ := NewCheckServiceAccount("aws", "foo", "allowed", "arn:aws:iam::111111111111:role/foo")
+	denied, _ := NewCheckServiceAccount("aws", "foo", "denied", "arn:aws:iam::111111111111:role/bar")
+	invalidTTL, _ := NewCheckServiceAccount("aws", "foo", "invalid-ttl", "arn:aws:iam::111111111111:role/foo")
+	invalidTTL.Annotations[defaultSTSTTLAnnotation] = "1m"
+	gcp, _ := NewCheckServiceAccount("gcp", "foo", "gcp", "foo@bar.iam.gserviceaccount.com")
+
+	results, err := Check(tmpConf.Name(), nil, &Manifests{ServiceAccounts: []*corev1.ServiceAccount{allowed, denied, invalidTTL, gcp}})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	// Test that the matching rule and the vault objects are reported
+	assert.True(t, results[0].OK())
+	assert.Equal(t, 1, results[0].Rule)
+	assert.Equal(t, "vkcc_aws_foo_allowed", results[0].Key)
+	assert.Equal(t, 15*time.Minute, results[0].TTL)
+	assert.Contains(t, results[0].Policy, `path "aws/sts/vkcc_aws_foo_allowed"`)
+	assert.Equal(t, []string{"arn:aws:iam::111111111111:role/foo"}, results[0].Payload["role_arns"])
+
+	// Test that a denied service account is reported with a reason
+	assert.False(t, results[1].OK())
+	assert.Equal(t, -1, results[1].Rule)
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar is not allowed in namespace foo by aws.rules", results[1].Reason)
+
+	// Test that an invalid ttl is reported as an error
+	assert.True(t, results[2].Allowed)
+	assert.False(t, results[2].OK())
+	assert.EqualError(t, results[2].Error, "minimum default-sts-ttl value allowed is 15m0s, its set to 1m0s")
+
+	// Test that the service accounts are evaluated for each provider
+	assert.Equal(t, "gcp", results[3].Provider)
+	assert.True(t, results[3].OK())
+	assert.Equal(t, -1, results[3].Rule)
+}
+
+// TestCheckWatchAccessRules tests that access rules are taken from the
+// manifests when they're watched, and that service accounts aren't evaluated
+// without them
+func TestCheckWatchAccessRules(t *testing.T) {
+	tmpConf, err := os.CreateTemp("", "vault-kube-cloud-test-*")
+	require.NoError(t, err)
+	defer os.Remove(tmpConf.Name())
+	_, err = tmpConf.WriteString(`
+providers:
+  - aws
+watchAccessRules: true
+aws:
+  rules:
+    - namespacePatterns:
+        - bar
+      roleNamePatterns:
+        - bar
+`)
+	require.NoError(t, err)
+	tmpConf.Close()
+
+	serviceAccount, _ := NewCheckServiceAccount("aws", "foo", "foo", "arn:aws:iam::111111111111:role/foo")
+
+	// Test that without access rules the result is unknown rather than
+	// allowed or denied by the rules in the config file
+	results, err := Check(tmpConf.Name(), nil, &Manifests{ServiceAccounts: []*corev1.ServiceAccount{serviceAccount}})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.False(t, results[0].OK())
+	assert.True(t, results[0].Unevaluated)
+	assert.Equal(t, "unevaluated: access rules are watched", results[0].Reason)
+	assert.Contains(t, results[0].String(), "allowed:  unknown (unevaluated: access rules are watched)")
+
+	// Test that the access rules in the manifests are evaluated after the
+	// rules in the config file
+	results, err = Check(tmpConf.Name(), nil, &Manifests{
+		ServiceAccounts: []*corev1.ServiceAccount{serviceAccount},
+		AWSAccessRules: []AWSAccessRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo"},
+				Spec: AWSRule{
+					NamespacePatterns: []string{"foo"},
+					RoleNamePatterns:  []string{"foo"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.True(t, results[0].OK())
+	assert.False(t, results[0].Unevaluated)
+	assert.Equal(t, 1, results[0].Rule)
+}
+
+// TestCheckNamespaceSelector tests that the labels of the namespaces in the
+// manifests are matched by namespace selectors, and that service accounts in
+// other namespaces aren't evaluated
+func TestCheckNamespaceSelector(t *testing.T) {
+	tmpConf, err := os.CreateTemp("", "vault-kube-cloud-test-*")
+	require.NoError(t, err)
+	defer os.Remove(tmpConf.Name())
+	_, err = tmpConf.WriteString(`
+providers:
+  - aws
+aws:
+  rules:
+    - namespaceSelector:
+        matchExpressions:
+          - key: team
+            operator: NotIn
+            values:
+              - bar
+      roleNamePatterns:
+        - foo
+`)
+	require.NoError(t, err)
+	tmpConf.Close()
+
+	manifests := &Manifests{}
+	require.NoError(t, manifests.Read(strings.NewReader(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: foo
+  labels:
+    team: foo
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: bar
+  labels:
+    team: bar
+`)))
+	require.Len(t, manifests.Namespaces, 2)
+
+	allowed, _ := NewCheckServiceAccount("aws", "foo", "allowed", "arn:aws:iam::111111111111:role/foo")
+	denied, _ := NewCheckServiceAccount("aws", "bar", "denied", "arn:aws:iam::111111111111:role/foo")
+	unknown, _ := NewCheckServiceAccount("aws", "baz", "unknown", "arn:aws:iam::111111111111:role/foo")
+	manifests.ServiceAccounts = []*corev1.ServiceAccount{allowed, denied, unknown}
+
+	results, err := Check(tmpConf.Name(), nil, manifests)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	// Test that the selector is matched against the labels of the
+	// namespace
+	assert.True(t, results[0].OK())
+	assert.Equal(t, 0, results[0].Rule)
+	assert.False(t, results[1].OK())
+	assert.False(t, results[1].Unevaluated)
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/foo is not allowed in namespace bar by aws.rules", results[1].Reason)
+
+	// Test that a namespace that isn't in the manifests isn't treated as
+	// having no labels, which the selector would allow
+	assert.False(t, results[2].OK())
+	assert.True(t, results[2].Unevaluated)
+	assert.Contains(t, results[2].String(), "allowed:  unknown (namespace labels not provided)")
+}
@@ -11,8 +11,13 @@ import (
 
 var defaultFileConfig = &fileConfig{
 	KubernetesAuthBackend: "kubernetes",
+	HealthProbeAddress:    ":8081",
 	MetricsAddress:        ":8080",
 	Prefix:                "vkcc",
+	Providers:             []string{"aws"},
+	// Service accounts are reconciled when they change, so garbage is only
+	// left behind by missed deletions
+	GarbageCollectionInterval: time.Hour,
 	AWS: awsFileConfig{
 		DefaultTTL: 15 * time.Minute,
 		MinTTL:     15 * time.Minute, // min allowed STS TTL by AWS is 15m
@@ -22,20 +27,63 @@ var defaultFileConfig = &fileConfig{
 		Path:       "gcp",
 		DefaultTTL: 1 * time.Hour,
 	},
+	Azure: azureFileConfig{
+		Path:       "azure",
+		DefaultTTL: 1 * time.Hour,
+	},
 }
 
 type fileConfig struct {
 	// KubernetesAuthBackend is the mount path of the kubernetes auth
 	// backend
 	KubernetesAuthBackend string `yaml:"kubernetesAuthBackend"`
+	// HealthProbeAddress is the address the liveness and readiness probes
+	// are served on
+	HealthProbeAddress string `yaml:"healthProbeAddress"`
+	// LeaderElection is configuration for running multiple replicas of the
+	// operator
+	LeaderElection leaderElectionFileConfig `yaml:"leaderElection"`
 	// MetricsAddress is the address metrics are served on
 	MetricsAddress string `yaml:"metricsAddress"`
 	// Prefix is appended to objects created in Vault by the operator
 	Prefix string `yaml:"prefix"`
+	// Providers are the cloud providers that the operator manages
+	Providers []string `yaml:"providers"`
+	// WatchAccessRules enables rules from the AWSAccessRule, GCPAccessRule
+	// and AzureAccessRule resources in addition to the rules in this file
+	WatchAccessRules bool `yaml:"watchAccessRules"`
 	// AWS is configuration for the AWS secret backend
 	AWS awsFileConfig `yaml:"aws"`
 	// GCP is configuration for the GCP secret backend
 	GCP gcpFileConfig `yaml:"gcp"`
+	// Azure is configuration for the Azure secret backend
+	Azure azureFileConfig `yaml:"azure"`
+	// VaultAuth is the auth method that the operator logs in to vault with
+	VaultAuth vaultAuthFileConfig `yaml:"vaultAuth"`
+	// VaultNamespace is the vault namespace that the operator logs in to
+	// and writes objects to, unless a rule sets another one. Defaults to
+	// the value of VAULT_NAMESPACE.
+	VaultNamespace string `yaml:"vaultNamespace"`
+	// GarbageCollectionInterval is how often the objects of removed
+	// serviceaccounts are garbage collected from vault, in addition to
+	// when the operator starts. Disabled if it's 0.
+	GarbageCollectionInterval time.Duration `yaml:"garbageCollectionInterval"`
+	// DriftRepairInterval is how often every serviceaccount is reconciled,
+	// so that objects changed in vault outside of the operator are
+	// rewritten. Disabled if it's 0.
+	DriftRepairInterval time.Duration `yaml:"driftRepairInterval"`
+}
+
+type leaderElectionFileConfig struct {
+	// Enabled ensures that only one replica of the operator reconciles
+	// serviceaccounts and garbage collects at any one time
+	Enabled bool `yaml:"enabled"`
+	// ID is the name of the Lease used to elect a leader. Defaults to a
+	// name derived from the enabled providers
+	ID string `yaml:"id"`
+	// Namespace is the namespace of the Lease. Defaults to the namespace
+	// the operator is running in
+	Namespace string `yaml:"namespace"`
 }
 
 type awsFileConfig struct {
@@ -45,6 +93,13 @@ type awsFileConfig struct {
 	MinTTL time.Duration `yaml:"minTTL"`
 	// Path is the mount path of the AWS secret backend
 	Path string `yaml:"path"`
+	// PartitionPaths are the mount paths of the AWS secret backends for
+	// roles in other partitions, like aws-cn or aws-us-gov. Roles in
+	// partitions that aren't listed use Path.
+	PartitionPaths map[string]string `yaml:"partitionPaths"`
+	// PolicyTemplate replaces the built-in template of the vault policy
+	// that is written for each service account
+	PolicyTemplate string `yaml:"policyTemplate"`
 	// Rules that govern which service accounts can assume which roles
 	Rules AWSRules `yaml:"rules"`
 }
@@ -54,10 +109,25 @@ type gcpFileConfig struct {
 	DefaultTTL time.Duration `yaml:"defaultTTL"`
 	// Path is the mount path of the AS secret backend
 	Path string `yaml:"path"`
+	// PolicyTemplate replaces the built-in template of the vault policy
+	// that is written for each service account
+	PolicyTemplate string `yaml:"policyTemplate"`
 	// Rules that govern which service accounts can assume which roles
 	Rules GCPRules `yaml:"rules"`
 }
 
+type azureFileConfig struct {
+	// DefaultTTL is the default ttl of credentials that are issued for a role if not set
+	DefaultTTL time.Duration `yaml:"defaultTTL"`
+	// Path is the mount path of the Azure secret backend
+	Path string `yaml:"path"`
+	// PolicyTemplate replaces the built-in template of the vault policy
+	// that is written for each service account
+	PolicyTemplate string `yaml:"policyTemplate"`
+	// Rules that govern which service accounts can use which identities
+	Rules AzureRules `yaml:"rules"`
+}
+
 func loadConfigFromFile(file string) (*fileConfig, error) {
 	defaultCfg := *defaultFileConfig
 
@@ -79,9 +149,62 @@ func loadConfigFromFile(file string) (*fileConfig, error) {
 		return nil, fmt.Errorf("prefix must not contain a '_': %s", cfg.Prefix)
 	}
 
+	if cfg.GarbageCollectionInterval < 0 {
+		return nil, fmt.Errorf("garbageCollectionInterval can't be negative")
+	}
+
+	if cfg.DriftRepairInterval < 0 {
+		return nil, fmt.Errorf("driftRepairInterval can't be negative")
+	}
+
 	if cfg.AWS.Path == "" {
 		return nil, fmt.Errorf("aws.path can't be empty")
 	}
 
+	for partition, path := range cfg.AWS.PartitionPaths {
+		if path == "" {
+			return nil, fmt.Errorf("aws.partitionPaths.%s can't be empty", partition)
+		}
+	}
+
+	if cfg.Azure.Path == "" {
+		return nil, fmt.Errorf("azure.path can't be empty")
+	}
+
+	if err := cfg.VaultAuth.validate(); err != nil {
+		return nil, fmt.Errorf("vaultAuth: %w", err)
+	}
+
+	for _, pt := range []struct{ field, text string }{
+		{"aws.policyTemplate", cfg.AWS.PolicyTemplate},
+		{"gcp.policyTemplate", cfg.GCP.PolicyTemplate},
+		{"azure.policyTemplate", cfg.Azure.PolicyTemplate},
+	} {
+		if pt.text == "" {
+			continue
+		}
+		if _, err := parsePolicyTemplate(pt.text); err != nil {
+			return nil, fmt.Errorf("%s: %w", pt.field, err)
+		}
+	}
+
+	for i, r := range cfg.AWS.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("aws.rules[%d]: %w", i, err)
+		}
+	}
+
+	for i, r := range cfg.GCP.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("gcp.rules[%d]: %w", i, err)
+		}
+	}
+
+	for i, r := range cfg.Azure.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("azure.rules[%d]: %w", i, err)
+		}
+	}
+
 	return cfg, nil
 }
@@ -4,6 +4,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func Test_loadConfigFromFile(t *testing.T) {
@@ -27,9 +30,12 @@ func Test_loadConfigFromFile(t *testing.T) {
 			"default",
 			args{``},
 			&fileConfig{
-				KubernetesAuthBackend: "kubernetes",
-				MetricsAddress:        ":8080",
-				Prefix:                "vkcc",
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8080",
+				Prefix:                    "vkcc",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
 				AWS: awsFileConfig{
 					DefaultTTL: 900000000000,
 					MinTTL:     900000000000,
@@ -39,6 +45,10 @@ func Test_loadConfigFromFile(t *testing.T) {
 					DefaultTTL: 3600000000000,
 					Path:       "gcp",
 				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
 			},
 			false,
 		}, {
@@ -58,9 +68,12 @@ aws:
         - "123456789"
 `},
 			&fileConfig{
-				KubernetesAuthBackend: "kubernetes",
-				MetricsAddress:        ":8081",
-				Prefix:                "test-1",
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8081",
+				Prefix:                    "test-1",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
 				AWS: awsFileConfig{
 					DefaultTTL: 3600000000000,
 					MinTTL:     1800000000000,
@@ -77,6 +90,10 @@ aws:
 					DefaultTTL: 3600000000000,
 					Path:       "gcp",
 				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
 			},
 			false,
 		}, {
@@ -95,9 +112,12 @@ gcp:
         - bar-*@baz.iam.gserviceaccount.com
 `},
 			&fileConfig{
-				KubernetesAuthBackend: "kubernetes",
-				MetricsAddress:        ":8081",
-				Prefix:                "test-1",
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8081",
+				Prefix:                    "test-1",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
 				AWS: awsFileConfig{
 					DefaultTTL: 900000000000,
 					MinTTL:     900000000000,
@@ -113,8 +133,333 @@ gcp:
 						},
 					},
 				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
+			},
+			false,
+		}, {
+			"customAzureConfig",
+			args{`
+prefix: test-1
+azure:
+  defaultTTL: 30m
+  rules:
+    - namespacePatterns:
+        - kube-system
+      subscriptionIDs:
+        - 00000000-0000-0000-0000-000000000000
+      resourceGroupPatterns:
+        - sys-*
+      applicationObjectIDs:
+        - 11111111-1111-1111-1111-111111111111
+`},
+			&fileConfig{
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8080",
+				Prefix:                    "test-1",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
+				AWS: awsFileConfig{
+					DefaultTTL: 900000000000,
+					MinTTL:     900000000000,
+					Path:       "aws",
+				},
+				GCP: gcpFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "gcp",
+				},
+				Azure: azureFileConfig{
+					DefaultTTL: 1800000000000,
+					Path:       "azure",
+					Rules: AzureRules{
+						AzureRule{
+							NamespacePatterns:     []string{"kube-system"},
+							SubscriptionIDs:       []string{"00000000-0000-0000-0000-000000000000"},
+							ResourceGroupPatterns: []string{"sys-*"},
+							ApplicationObjectIDs:  []string{"11111111-1111-1111-1111-111111111111"},
+						},
+					},
+				},
+			},
+			false,
+		}, {
+			"multipleProviders",
+			args{`
+providers:
+  - aws
+  - gcp
+`},
+			&fileConfig{
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8080",
+				Prefix:                    "vkcc",
+				Providers:                 []string{"aws", "gcp"},
+				GarbageCollectionInterval: 3600000000000,
+				AWS: awsFileConfig{
+					DefaultTTL: 900000000000,
+					MinTTL:     900000000000,
+					Path:       "aws",
+				},
+				GCP: gcpFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "gcp",
+				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
 			},
 			false,
+		}, {
+			"intervals",
+			args{`
+garbageCollectionInterval: 30m
+driftRepairInterval: 6h
+`},
+			&fileConfig{
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8080",
+				Prefix:                    "vkcc",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 1800000000000,
+				DriftRepairInterval:       21600000000000,
+				AWS: awsFileConfig{
+					DefaultTTL: 900000000000,
+					MinTTL:     900000000000,
+					Path:       "aws",
+				},
+				GCP: gcpFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "gcp",
+				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
+			},
+			false,
+		}, {
+			"leaderElection",
+			args{`
+leaderElection:
+  enabled: true
+  id: vkcc-operator
+  namespace: sys-vault
+`},
+			&fileConfig{
+				KubernetesAuthBackend: "kubernetes",
+				HealthProbeAddress:    ":8081",
+				LeaderElection: leaderElectionFileConfig{
+					Enabled:   true,
+					ID:        "vkcc-operator",
+					Namespace: "sys-vault",
+				},
+				MetricsAddress:            ":8080",
+				Prefix:                    "vkcc",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
+				AWS: awsFileConfig{
+					DefaultTTL: 900000000000,
+					MinTTL:     900000000000,
+					Path:       "aws",
+				},
+				GCP: gcpFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "gcp",
+				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
+			},
+			false,
+		}, {
+			"namespaceSelector",
+			args{`
+aws:
+  rules:
+    - namespaceSelector:
+        matchLabels:
+          team: payments
+        matchExpressions:
+          - key: env
+            operator: In
+            values:
+              - dev
+              - prod
+      roleNamePatterns:
+        - payments-*
+      maxTTL: 1h
+`},
+			&fileConfig{
+				KubernetesAuthBackend:     "kubernetes",
+				HealthProbeAddress:        ":8081",
+				MetricsAddress:            ":8080",
+				Prefix:                    "vkcc",
+				Providers:                 []string{"aws"},
+				GarbageCollectionInterval: 3600000000000,
+				AWS: awsFileConfig{
+					DefaultTTL: 900000000000,
+					MinTTL:     900000000000,
+					Path:       "aws",
+					Rules: AWSRules{
+						AWSRule{
+							NamespaceSelector: &LabelSelector{
+								MatchLabels: map[string]string{"team": "payments"},
+								MatchExpressions: []metav1.LabelSelectorRequirement{
+									{Key: "env", Operator: metav1.LabelSelectorOpIn, Values: []string{"dev", "prod"}},
+								},
+							},
+							RoleNamePatterns: []string{"payments-*"},
+							MaxTTL:           Duration{time.Hour},
+						},
+					},
+				},
+				GCP: gcpFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "gcp",
+				},
+				Azure: azureFileConfig{
+					DefaultTTL: 3600000000000,
+					Path:       "azure",
+				},
+			},
+			false,
+		}, {
+			"invalidNamespaceSelector",
+			args{`
+gcp:
+  rules:
+    - namespaceSelector:
+        matchExpressions:
+          - key: team
+            operator: Like
+`},
+			nil,
+			true,
+		}, {
+			"invalidRoleTemplate",
+			args{`
+aws:
+  rules:
+    - namespacePatterns:
+        - foo
+      roleNamePatterns:
+        - foo
+      roleTemplate: arn:aws:iam::111111111111:role/{{ .Namespace
+`},
+			nil,
+			true,
+		}, {
+			"invalidPolicyTemplate",
+			args{`
+gcp:
+  policyTemplate: |
+    path "{{ .Path }}/token/{{ .Name }}" {
+      capabilities = ["read"]
+`},
+			nil,
+			true,
+		}, {
+			"invalidRulePolicyTemplate",
+			args{`
+aws:
+  rules:
+    - namespacePatterns:
+        - foo
+      roleNamePatterns:
+        - foo
+      policyTemplate: |
+        path "kv/data/{{ .Namespace }}/*" {
+          capabilities = ["read"
+        }
+`},
+			nil,
+			true,
+		}, {
+			"invalidVaultAuthMethod",
+			args{`
+vaultAuth:
+  method: token
+`},
+			nil,
+			true,
+		}, {
+			"vaultAuthWithoutRole",
+			args{`
+vaultAuth:
+  method: kubernetes
+`},
+			nil,
+			true,
+		}, {
+			"negativeGarbageCollectionInterval",
+			args{`
+garbageCollectionInterval: -1h
+`},
+			nil,
+			true,
+		}, {
+			"invalidAzureSubscriptionID",
+			args{`
+azure:
+  rules:
+    - namespacePatterns:
+        - foo
+      subscriptionIDs:
+        - foo
+`},
+			nil,
+			true,
+		}, {
+			"invalidAzureResourceGroupPattern",
+			args{`
+azure:
+  rules:
+    - namespacePatterns:
+        - foo
+      resourceGroupPatterns:
+        - "foo-["
+`},
+			nil,
+			true,
+		}, {
+			"invalidRuleTTLs",
+			args{`
+gcp:
+  rules:
+    - namespacePatterns:
+        - foo
+      serviceAccountEmailPatterns:
+        - foo
+      minTTL: 2h
+      maxTTL: 1h
+`},
+			nil,
+			true,
+		}, {
+			"invalidAWSExpression",
+			args{`
+aws:
+  rules:
+    - expression: namespace ==
+`},
+			nil,
+			true,
+		}, {
+			"nonBoolGCPExpression",
+			args{`
+gcp:
+  rules:
+    - expression: project
+`},
+			nil,
+			true,
 		},
 	}
 	for _, tt := range tests {
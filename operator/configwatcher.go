@@ -0,0 +1,134 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatcher reloads the config file when it changes and passes the new
+// rules, ttl settings and policy templates to the operators
+type configWatcher struct {
+	file      string
+	config    *fileConfig
+	operators []*Operator
+}
+
+// NeedLeaderElection returns false so that standby replicas also keep their
+// config up to date and can take over with the latest rules
+func (cw *configWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+// Start watches the directory of the config file, rather than the file
+// itself, so that the atomic symlink swap used when a ConfigMap volume is
+// updated is picked up
+func (cw *configWatcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(cw.file)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			cw.reload()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error(err, "error watching config file", "file", cw.file)
+		}
+	}
+}
+
+// reload loads the config file and, if it is valid and has changed, updates
+// the operators with it. An invalid config is logged and the current config
+// is kept.
+func (cw *configWatcher) reload() {
+	fc, err := loadConfigFromFile(cw.file)
+	if err != nil {
+		log.Error(err, "error reloading config file, keeping the current config", "file", cw.file)
+		return
+	}
+
+	if reflect.DeepEqual(fc, cw.config) {
+		return
+	}
+
+	// The objects under the old paths in vault wouldn't be found to update
+	// or remove them, so a config that moves them is rejected rather than
+	// only partly applied
+	if fields := cw.vaultPathsChanged(fc); len(fields) > 0 {
+		log.Error(fmt.Errorf("%s can't be changed while running", strings.Join(fields, ", ")), "rejecting config file change, keeping the current config until a restart", "file", cw.file)
+		return
+	}
+
+	for _, field := range cw.restartRequired(fc) {
+		log.Info("config field changed but only takes effect after a restart", "field", field)
+	}
+
+	log.Info("config file changed, re-evaluating all serviceaccounts", "file", cw.file)
+
+	for _, o := range cw.operators {
+		o.updateConfig(fc)
+	}
+	cw.config = fc
+}
+
+// vaultPathsChanged returns the fields that differ between the current and the
+// new config which decide the paths of the objects in vault
+func (cw *configWatcher) vaultPathsChanged(fc *fileConfig) []string {
+	return changedFields(map[string]bool{
+		"kubernetesAuthBackend": cw.config.KubernetesAuthBackend != fc.KubernetesAuthBackend,
+		"prefix":                cw.config.Prefix != fc.Prefix,
+		"aws.path":              cw.config.AWS.Path != fc.AWS.Path,
+		"aws.partitionPaths":    !reflect.DeepEqual(cw.config.AWS.PartitionPaths, fc.AWS.PartitionPaths),
+		"gcp.path":              cw.config.GCP.Path != fc.GCP.Path,
+		"azure.path":            cw.config.Azure.Path != fc.Azure.Path,
+	})
+}
+
+// restartRequired returns the fields that differ between the current and the
+// new config which only take effect after a restart
+func (cw *configWatcher) restartRequired(fc *fileConfig) []string {
+	return changedFields(map[string]bool{
+		"healthProbeAddress":        cw.config.HealthProbeAddress != fc.HealthProbeAddress,
+		"leaderElection":            cw.config.LeaderElection != fc.LeaderElection,
+		"metricsAddress":            cw.config.MetricsAddress != fc.MetricsAddress,
+		"providers":                 !reflect.DeepEqual(cw.config.Providers, fc.Providers),
+		"watchAccessRules":          cw.config.WatchAccessRules != fc.WatchAccessRules,
+		"vaultAuth":                 cw.config.VaultAuth != fc.VaultAuth,
+		"vaultNamespace":            cw.config.VaultNamespace != fc.VaultNamespace,
+		"garbageCollectionInterval": cw.config.GarbageCollectionInterval != fc.GarbageCollectionInterval,
+		"driftRepairInterval":       cw.config.DriftRepairInterval != fc.DriftRepairInterval,
+	})
+}
+
+// changedFields returns the names of the fields that have changed, in order
+func changedFields(changes map[string]bool) []string {
+	var fields []string
+	for field, changed := range changes {
+		if changed {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	return fields
+}
@@ -0,0 +1,106 @@
+package operator
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConfigWatcherReload tests that a changed config file replaces the rules
+// and ttl settings of the operators and triggers a reconcile of every
+// serviceaccount, while an invalid file is ignored
+func TestConfigWatcherReload(t *testing.T) {
+	tmpConf, err := os.CreateTemp("", "vault-kube-cloud-test-*")
+	require.NoError(t, err)
+	tmpConf.Close()
+	defer os.Remove(tmpConf.Name())
+
+	fc, err := loadConfigFromFile(tmpConf.Name())
+	require.NoError(t, err)
+
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(&Config{}, aws)
+
+	cw := &configWatcher{
+		file:      tmpConf.Name(),
+		config:    fc,
+		operators: []*Operator{o},
+	}
+
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")))
+
+	// Test that an unchanged config doesn't trigger a reconcile
+	cw.reload()
+	assert.Len(t, o.reconcileAll, 0)
+
+	require.NoError(t, os.WriteFile(tmpConf.Name(), []byte(`
+aws:
+  defaultTTL: 1h
+  rules:
+    - namespacePatterns:
+        - bar
+      roleNamePatterns:
+        - bar
+      accountIDs:
+        - 111111111111
+`), 0o644))
+	cw.reload()
+
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")))
+	serviceAccount := annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")
+	ttl, err := aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+	assert.Len(t, o.reconcileAll, 1)
+
+	// Test that an invalid config is ignored
+	<-o.reconcileAll
+	require.NoError(t, os.WriteFile(tmpConf.Name(), []byte(`prefix: foo_bar`), 0o644))
+	cw.reload()
+
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")))
+	assert.Len(t, o.reconcileAll, 0)
+
+	// Test that the policy template is reloaded
+	require.NoError(t, os.WriteFile(tmpConf.Name(), []byte(`
+aws:
+  policyTemplate: |
+    path "{{ .Path }}/sts/{{ .Name }}" {
+      capabilities = ["read"]
+    }
+    path "kv/data/{{ .Namespace }}/*" {
+      capabilities = ["read"]
+    }
+`), 0o644))
+	cw.reload()
+
+	serviceAccount = annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")
+	policy, err := aws.renderPolicyTemplate("vkcc_aws_foo_bar", serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Contains(t, policy, `path "kv/data/foo/*"`)
+	assert.Len(t, o.reconcileAll, 1)
+
+	// Test that a config which moves the objects in vault is rejected
+	<-o.reconcileAll
+	require.NoError(t, os.WriteFile(tmpConf.Name(), []byte(`
+aws:
+  partitionPaths:
+    aws-cn: aws-cn
+`), 0o644))
+	cw.reload()
+
+	rejected, err := loadConfigFromFile(tmpConf.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aws.partitionPaths"}, cw.vaultPathsChanged(rejected))
+	assert.Empty(t, cw.config.AWS.PartitionPaths)
+	assert.Empty(t, aws.PartitionPaths)
+	serviceAccount = annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar")
+	policy, err = aws.renderPolicyTemplate("vkcc_aws_foo_bar", serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Contains(t, policy, `path "kv/data/foo/*"`)
+	assert.Len(t, o.reconcileAll, 0)
+}
@@ -3,13 +3,21 @@ package operator
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 )
 
@@ -17,92 +25,253 @@ var log = ctrl.Log.WithName("operator")
 
 // Config is the base configuration for an operator
 type Config struct {
-	KubeClient            client.Client
-	KubernetesAuthBackend string
-	Prefix                string
-	VaultClient           *vault.Client
-	VaultConfig           *vault.Config
+	// DriftRepairInterval is how often every service account is
+	// reconciled, never if it's 0
+	DriftRepairInterval time.Duration
+	// DryRun reports the changes that would be made to vault instead of
+	// making them. Changes are also written as lines of JSON to
+	// DryRunOutput, if it's set.
+	DryRun       bool
+	DryRunOutput io.Writer
+	// GarbageCollectionInterval is how often garbage collection runs after
+	// the operator starts, never if it's 0
+	GarbageCollectionInterval time.Duration
+	KubeClient                client.Client
+	KubernetesAuthBackend     string
+	Prefix                    string
+	Recorder                  events.EventRecorder
+	VaultClient               *vault.Client
+	VaultConfig               *vault.Config
+	WatchAccessRules          bool
 }
 
 // Controller is responsible for providing access to cloud IAM roles for
 // Kubernetes serviceaccounts based on annotations
 type Controller struct {
-	mgr ctrl.Manager
+	leaderElection bool
+	mgr            ctrl.Manager
 }
 
-// New creates a new operator from the configuration in the provided file
-func New(configFile, provider string) (*Controller, error) {
+// New creates a new operator from the configuration in the provided file. An
+// Operator is registered on the same manager for each of the given providers,
+// or for the providers listed in the configuration file if none are given.
+// With dryRun the operator only reports the changes it would make to vault,
+// in the logs and as JSON to dryRunOutput if it isn't nil.
+func New(configFile string, providers []string, dryRun bool, dryRunOutput io.Writer) (*Controller, error) {
 	fc, err := loadConfigFromFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(providers) == 0 {
+		providers = fc.Providers
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("at least one operator provider must be enabled")
+	}
+
 	scheme := runtime.NewScheme()
 
 	_ = clientgoscheme.AddToScheme(scheme)
 	_ = corev1.AddToScheme(scheme)
+	_ = AddToScheme(scheme)
+
+	leaderElectionID := fc.LeaderElection.ID
+	if leaderElectionID == "" {
+		leaderElectionID = "vault-kube-cloud-credentials-" + strings.Join(providers, "-")
+	}
+
+	// A dry-run doesn't change anything, so it can run alongside the
+	// elected leader
+	leaderElection := fc.LeaderElection.Enabled && !dryRun
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:         scheme,
-		Metrics:        metricsserver.Options{BindAddress: fc.MetricsAddress},
-		LeaderElection: false,
+		Scheme:                  scheme,
+		Metrics:                 metricsserver.Options{BindAddress: fc.MetricsAddress},
+		HealthProbeBindAddress:  fc.HealthProbeAddress,
+		LeaderElection:          leaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: fc.LeaderElection.Namespace,
+		// The process exits as soon as the manager stops, so the lease
+		// can be released to speed up the failover to a standby replica
+		LeaderElectionReleaseOnCancel: true,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	vaultConfig := vault.DefaultConfig()
-	vaultClient, err := vault.NewClient(vaultConfig)
-	if err != nil {
+	// Standby replicas are ready as soon as their cache is in sync, so that
+	// they can take over from the leader and rollouts aren't blocked on an
+	// election. The operators register the informers of the types they
+	// watch on the cache, so the check covers them on standbys too.
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return nil, err
+	}
+	if err := mgr.AddReadyzCheck("cache-sync", func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !mgr.GetCache().WaitForCacheSync(ctx) {
+			return fmt.Errorf("cache not synced")
+		}
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 
-	config := &Config{
-		KubeClient:            mgr.GetClient(),
-		KubernetesAuthBackend: fc.KubernetesAuthBackend,
-		Prefix:                fc.Prefix,
-		VaultClient:           vaultClient,
-		VaultConfig:           vaultConfig,
+	// The operators log in to vault with an auth method if one is
+	// configured, rather than using the token in the environment
+	var va *vaultAuth
+	if fc.VaultAuth.Method != "" {
+		va = newVaultAuth(fc.VaultAuth)
 	}
 
-	log.Info("Starting " + provider + " operator...")
-	switch provider {
-	case "aws":
-		aws, err := NewAWSProvider(fc.AWS)
+	var operators []*Operator
+	enabled := map[string]bool{}
+	for _, name := range providers {
+		if enabled[name] {
+			return nil, fmt.Errorf("operator provider '%s' is enabled more than once", name)
+		}
+		enabled[name] = true
+
+		p, err := newProvider(name, fc)
 		if err != nil {
 			return nil, err
 		}
 
-		ao, err := NewOperator(config, aws)
+		// Each operator has its own vault client, so that the vault
+		// metrics can be labelled with the provider
+		vaultClient, vaultConfig, err := newVaultClient(name, va)
 		if err != nil {
 			return nil, err
 		}
+		if fc.VaultNamespace != "" {
+			vaultClient.SetNamespace(fc.VaultNamespace)
+		}
 
-		if err := ao.SetupWithManager(mgr); err != nil {
+		o, err := NewOperator(&Config{
+			DriftRepairInterval:       fc.DriftRepairInterval,
+			DryRun:                    dryRun,
+			DryRunOutput:              dryRunOutput,
+			GarbageCollectionInterval: fc.GarbageCollectionInterval,
+			KubeClient:                mgr.GetClient(),
+			KubernetesAuthBackend:     fc.KubernetesAuthBackend,
+			Prefix:                    fc.Prefix,
+			Recorder:                  mgr.GetEventRecorder("vault-kube-cloud-credentials"),
+			VaultClient:               vaultClient,
+			VaultConfig:               vaultConfig,
+			WatchAccessRules:          fc.WatchAccessRules,
+		}, p)
+		if err != nil {
 			return nil, err
 		}
-	case "gcp":
-		gcp, err := NewGCPProvider(fc.GCP)
-		if err != nil {
+
+		if err := o.SetupWithManager(mgr); err != nil {
 			return nil, err
 		}
+		operators = append(operators, o)
 
-		gco, err := NewOperator(config, gcp)
-		if err != nil {
+		log.Info("Starting " + name + " operator...")
+	}
+
+	if va != nil {
+		if err := va.login(context.Background()); err != nil {
+			return nil, err
+		}
+		if err := mgr.Add(va); err != nil {
 			return nil, err
 		}
+	}
 
-		if err := gco.SetupWithManager(mgr); err != nil {
+	if configFile != "" {
+		if err := mgr.Add(&configWatcher{
+			file:      configFile,
+			config:    fc,
+			operators: operators,
+		}); err != nil {
 			return nil, err
 		}
-	default:
-		return nil, fmt.Errorf("wrong operator provider. must be one of 'aws' or 'gcp'")
 	}
 
-	return &Controller{mgr: mgr}, nil
+	return &Controller{
+		leaderElection: leaderElection,
+		mgr:            mgr,
+	}, nil
 }
 
-// Start runs the operator
+// newVaultClient returns a vault client with requests instrumented for the
+// given provider. The vault client doesn't accept a wrapped transport when
+// reading its configuration from the environment, so the client is given a
+// copy of the http client with the instrumented transport and the returned
+// config keeps the original. Reloading the config from the environment
+// updates the TLS config of the transport they share, which picks up CA cert
+// rotations. With an auth method, the client is logged in by the vault auth,
+// which is signalled by the transport when vault denies a request.
+func newVaultClient(providerName string, va *vaultAuth) (*vault.Client, *vault.Config, error) {
+	vaultConfig := vault.DefaultConfig()
+	if vaultConfig.Error != nil {
+		return nil, nil, vaultConfig.Error
+	}
+
+	labels := prometheus.Labels{"provider": providerName}
+	httpClient := *vaultConfig.HttpClient
+	httpClient.Transport = promhttp.InstrumentRoundTripperInFlight(promVaultRequestsInFlight.With(labels),
+		promhttp.InstrumentRoundTripperCounter(promVaultRequests.MustCurryWith(labels),
+			promhttp.InstrumentRoundTripperDuration(promVaultRequestsDuration.MustCurryWith(labels), vaultConfig.HttpClient.Transport),
+		),
+	)
+
+	if va != nil {
+		httpClient.Transport = va.transport(httpClient.Transport)
+	}
+
+	clientConfig := vault.DefaultConfig()
+	clientConfig.HttpClient = &httpClient
+
+	vaultClient, err := vault.NewClient(clientConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if va != nil {
+		va.addClient(vaultClient)
+	}
+
+	return vaultClient, vaultConfig, nil
+}
+
+// newProvider returns the provider with the given name, configured from the
+// provided file config
+func newProvider(name string, fc *fileConfig) (provider, error) {
+	switch name {
+	case "aws":
+		return NewAWSProvider(fc.AWS)
+	case "gcp":
+		return NewGCPProvider(fc.GCP)
+	case "azure":
+		return NewAzureProvider(fc.Azure)
+	default:
+		return nil, fmt.Errorf("wrong operator provider '%s'. must be one of 'aws', 'gcp' or 'azure'", name)
+	}
+}
+
+// Start runs the operator. When leader election is enabled, reconciles and
+// garbage collection only run once this replica has been elected, which is
+// exposed by the leader metric. Standby replicas are ready, so it's the metric
+// that distinguishes the leader from them.
 func (o *Controller) Start(ctx context.Context) error {
+	if o.leaderElection {
+		log.Info("waiting to be elected as leader")
+		promLeader.Set(0)
+		go func() {
+			select {
+			case <-o.mgr.Elected():
+				log.Info("elected as leader, starting reconciliation")
+				promLeader.Set(1)
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		promLeader.Set(1)
+	}
+
 	return o.mgr.Start(ctx)
 }
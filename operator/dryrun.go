@@ -0,0 +1,274 @@
+package operator
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Actions reported in dry-run mode
+const (
+	dryRunActionCreate = "create"
+	dryRunActionUpdate = "update"
+	dryRunActionDelete = "delete"
+)
+
+// dryRunChange is a change that the operator would make to vault if it wasn't
+// running in dry-run mode
+type dryRunChange struct {
+	Provider       string                       `json:"provider"`
+	Action         string                       `json:"action"`
+	Kind           string                       `json:"kind"`
+	VaultNamespace string                       `json:"vaultNamespace,omitempty"`
+	Path           string                       `json:"path"`
+	Diff           map[string]dryRunFieldChange `json:"diff,omitempty"`
+}
+
+// dryRunFieldChange is the current and desired value of a field of an object
+// in vault
+type dryRunFieldChange struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// planWrite reads the current state of the object from vault and reports
+// whether it would be created or updated, along with the fields that would
+// change
+func (o *Operator) planWrite(obj vaultObject) error {
+	current, err := o.readFromVault(obj)
+	if err != nil {
+		return err
+	}
+
+	action := dryRunActionCreate
+	if current != nil {
+		action = dryRunActionUpdate
+	}
+
+	diff := diffVaultData(current, obj.data)
+	if len(diff) == 0 {
+		o.log.V(1).Info("dry-run: unchanged "+obj.kind, "path", obj.path)
+		return nil
+	}
+
+	return o.reportChange(dryRunChange{
+		Action:         action,
+		Kind:           obj.kind,
+		VaultNamespace: obj.namespace,
+		Path:           obj.path,
+		Diff:           diff,
+	})
+}
+
+// planDelete reports that the existing object would be deleted
+func (o *Operator) planDelete(obj vaultObject) error {
+	return o.reportChange(dryRunChange{
+		Action:         dryRunActionDelete,
+		Kind:           obj.kind,
+		VaultNamespace: obj.namespace,
+		Path:           obj.path,
+	})
+}
+
+// reportChange logs the change and writes it as a line of JSON to the dry-run
+// output, if there is one
+func (o *Operator) reportChange(c dryRunChange) error {
+	c.Provider = o.provider.name()
+
+	o.log.Info(fmt.Sprintf("dry-run: would %s %s", c.Action, c.Kind), "vaultNamespace", c.VaultNamespace, "path", c.Path, "diff", c.Diff)
+
+	if o.DryRunOutput == nil {
+		return nil
+	}
+
+	return json.NewEncoder(o.DryRunOutput).Encode(c)
+}
+
+// vaultFieldDefaults are the values that vault returns for fields that the
+// operator doesn't write, when they aren't empty. Fields with a nil value are
+// derived by vault from other fields, and can't be written.
+var vaultFieldDefaults = map[string]interface{}{
+	// Kubernetes auth roles
+	"alias_name_source": "serviceaccount_uid",
+	"token_type":        "default",
+	// Policies
+	"name": nil,
+	// GCP static accounts
+	"service_account_project": nil,
+}
+
+// diffVaultData compares the fields that would be written to vault with the
+// fields that are currently there. Fields that are only returned by vault are
+// changed back to their defaults if they've been set outside of the operator,
+// for instance the token_policies of a kubernetes auth role or the
+// policy_arns of an AWS role, which would otherwise grant more than the rules
+// allow. The token_ fields that vault returns for the fields that are written
+// under their older names, like token_ttl for ttl, are compared under those.
+func diffVaultData(current, desired map[string]interface{}) map[string]dryRunFieldChange {
+	diff := map[string]dryRunFieldChange{}
+	for k, v := range desired {
+		old, ok := current[k]
+		if ok && equalVaultValues(old, v) {
+			continue
+		}
+		diff[k] = dryRunFieldChange{
+			Old: old,
+			New: v,
+		}
+	}
+
+	for k, v := range current {
+		if _, ok := desired[k]; ok {
+			continue
+		}
+		if _, ok := desired[strings.TrimPrefix(k, "token_")]; ok {
+			continue
+		}
+		def, ok := vaultFieldDefaults[k]
+		if ok && (def == nil || equalVaultValues(v, def)) {
+			continue
+		}
+		if !ok && isEmptyVaultValue(v) {
+			continue
+		}
+		if !ok {
+			def = emptyVaultValue(v)
+		}
+		diff[k] = dryRunFieldChange{
+			Old: v,
+			New: def,
+		}
+	}
+
+	return diff
+}
+
+// vaultWriteData returns the data that is written to vault for an object with
+// the given diff, which also changes the fields that were set outside of the
+// operator back to their defaults
+func vaultWriteData(desired map[string]interface{}, diff map[string]dryRunFieldChange) map[string]interface{} {
+	data := make(map[string]interface{}, len(desired))
+	for k, v := range desired {
+		data[k] = v
+	}
+	for k, c := range diff {
+		if _, ok := desired[k]; !ok {
+			data[k] = c.New
+		}
+	}
+
+	return data
+}
+
+// isEmptyVaultValue returns true if a value read from vault is the zero value
+// of its type, or an empty list or map
+func isEmptyVaultValue(v interface{}) bool {
+	switch v := normalizeVaultValue(v).(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+// emptyVaultValue returns the empty value of the type of a value read from
+// vault, which resets the field when it's written
+func emptyVaultValue(v interface{}) interface{} {
+	switch normalizeVaultValue(v).(type) {
+	case string:
+		return ""
+	case float64:
+		return 0
+	case bool:
+		return false
+	case []interface{}:
+		return []string{}
+	case map[string]interface{}:
+		return map[string]string{}
+	default:
+		return nil
+	}
+}
+
+// equalVaultValues compares a value read from vault with one that would be
+// written. Both are passed through JSON so that, for instance, numbers are
+// compared regardless of their type. Vault returns comma separated strings as
+// lists, so a string is equal to a list with the same elements. Fields that
+// are written as JSON, like the azure_roles of an Azure role, are returned
+// decoded, with fields that vault fills in, so they're equal if the decoded
+// value is contained in the current one.
+func equalVaultValues(current, desired interface{}) bool {
+	c, d := normalizeVaultValue(current), normalizeVaultValue(desired)
+	if s, ok := d.(string); ok {
+		if list, ok := c.([]interface{}); ok {
+			elems := make([]string, len(list))
+			for i, e := range list {
+				elems[i] = fmt.Sprint(e)
+			}
+			if strings.Join(elems, ",") == s {
+				return true
+			}
+		}
+		var decoded interface{}
+		if _, isString := c.(string); !isString && json.Unmarshal([]byte(s), &decoded) == nil {
+			return containsVaultValue(c, decoded)
+		}
+	}
+
+	return reflect.DeepEqual(c, d)
+}
+
+// containsVaultValue returns true if the current value has all of the fields in
+// the desired value, recursively
+func containsVaultValue(current, desired interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		c, ok := current.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range d {
+			if !containsVaultValue(c[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		c, ok := current.([]interface{})
+		if !ok || len(c) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !containsVaultValue(c[i], d[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(current, desired)
+	}
+}
+
+func normalizeVaultValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return v
+	}
+
+	return out
+}
@@ -0,0 +1,196 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// TestOperatorDryRun tests that in dry-run mode the changes to vault are
+// reported, diffed against the objects in vault, and never made
+func TestOperatorDryRun(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")
+	policy, err := aws.renderPolicyTemplate("vkcc_aws_foo_allowed", serviceAccount, matchRule(t, aws, serviceAccount))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := map[string]map[string]interface{}{
+		"/v1/sys/policies/acl/vkcc_aws_foo_allowed": {
+			"name":   "vkcc_aws_foo_allowed",
+			"policy": policy,
+		},
+		"/v1/auth/kubernetes/role/vkcc_aws_foo_allowed": {
+			"bound_service_account_names":      []string{"allowed"},
+			"bound_service_account_namespaces": []string{"foo"},
+			"policies":                         []string{"default", "vkcc_aws_foo_allowed"},
+			"token_ttl":                        600,
+			"ttl":                              600,
+		},
+		"/v1/aws/roles/vkcc_aws_foo_denied": {
+			"role_arns": []string{"arn:aws:iam::111111111111:role/foo-role"},
+		},
+	}
+
+	var writes []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writes = append(writes, r.Method+" "+r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		data, ok := existing[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().
+		WithObjects(
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "allowed",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+					},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "denied",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+					},
+				},
+			},
+		).
+		Build()
+
+	var output bytes.Buffer
+	o, _ := NewOperator(&Config{
+		DryRun:                true,
+		DryRunOutput:          &output,
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	for _, name := range []string{"allowed", "denied"} {
+		_, err := o.Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      name,
+				Namespace: "foo",
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.Empty(t, writes)
+
+	var changes []dryRunChange
+	dec := json.NewDecoder(&output)
+	for dec.More() {
+		var c dryRunChange
+		assert.NoError(t, dec.Decode(&c))
+		changes = append(changes, c)
+	}
+	assert.Equal(t, []dryRunChange{
+		{
+			Provider: "aws",
+			Action:   dryRunActionUpdate,
+			Kind:     "kubernetes auth backend role",
+			Path:     "auth/kubernetes/role/vkcc_aws_foo_allowed",
+			Diff: map[string]dryRunFieldChange{
+				"ttl": {Old: float64(600), New: float64(900)},
+			},
+		},
+		{
+			Provider: "aws",
+			Action:   dryRunActionCreate,
+			Kind:     "secret identity",
+			Path:     "aws/roles/vkcc_aws_foo_allowed",
+			Diff: map[string]dryRunFieldChange{
+				"credential_type": {New: "assumed_role"},
+				"default_sts_ttl": {New: float64(900)},
+				"max_sts_ttl":     {New: float64(43200)},
+				"role_arns":       {New: []interface{}{"arn:aws:iam::111111111111:role/foo-role"}},
+			},
+		},
+		{
+			Provider: "aws",
+			Action:   dryRunActionDelete,
+			Kind:     "secret identity",
+			Path:     "aws/roles/vkcc_aws_foo_denied",
+		},
+	}, changes)
+
+	// Test that the status annotations aren't written
+	sa := &corev1.ServiceAccount{}
+	assert.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Name: "allowed", Namespace: "foo"}, sa))
+	assert.NotContains(t, sa.Annotations, "vault.uw.systems/aws-sync-status")
+}
+
+func TestEqualVaultValues(t *testing.T) {
+	testCases := []struct {
+		name             string
+		current, desired interface{}
+		equal            bool
+	}{
+		{"numbers", json.Number("900"), 900.0, true},
+		{"differentNumbers", json.Number("600"), 900, false},
+		{"list", []interface{}{"a", "b"}, []string{"a", "b"}, true},
+		{"commaSeparatedString", []interface{}{"a", "b"}, "a,b", true},
+		{"differentCommaSeparatedString", []interface{}{"a", "b"}, "a,c", false},
+		{
+			"jsonString",
+			[]interface{}{map[string]interface{}{"role_id": "id", "role_name": "Reader", "scope": "/subscriptions/foo"}},
+			`[{"role_name":"Reader","scope":"/subscriptions/foo"}]`,
+			true,
+		},
+		{
+			"differentJSONString",
+			[]interface{}{map[string]interface{}{"role_id": "id", "role_name": "Reader", "scope": "/subscriptions/foo"}},
+			`[{"role_name":"Owner","scope":"/subscriptions/foo"}]`,
+			false,
+		},
+		{"string", "[]", "[]", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.equal, equalVaultValues(tc.current, tc.desired))
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package operator
 
 import (
-	"bytes"
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -42,8 +44,48 @@ type GCPRules []GCPRule
 // GCPRule restricts the GCP service accounts that a k8s serviceAccount can use
 // based on patterns which match its namespace to GCP service account email(s)
 type GCPRule struct {
-	NamespacePatterns       []string `yaml:"namespacePatterns"`
-	ServiceAccEmailPatterns []string `yaml:"serviceAccountEmailPatterns"`
+	NamespacePatterns       []string `yaml:"namespacePatterns" json:"namespacePatterns,omitempty"`
+	ServiceAccEmailPatterns []string `yaml:"serviceAccountEmailPatterns" json:"serviceAccountEmailPatterns,omitempty"`
+	// ProjectIDs are the projects that the GCP service accounts can belong
+	// to, any project if empty
+	ProjectIDs []string `yaml:"projectIDs" json:"projectIDs,omitempty"`
+	// AllowedScopes are the token scopes that the service accounts the rule
+	// admits can request, any scope if empty. Service accounts must request
+	// scopes if it isn't, rather than getting a service account key.
+	AllowedScopes []string `yaml:"allowedScopes" json:"allowedScopes,omitempty"`
+	// NamespaceSelector must also match the labels of the namespace of
+	// the service account. The namespace patterns aren't required with a
+	// selector.
+	NamespaceSelector *LabelSelector `yaml:"namespaceSelector" json:"namespaceSelector,omitempty"`
+	// ServiceAccountNamePatterns and ServiceAccountSelector narrow the
+	// rule to service accounts with matching names and labels
+	ServiceAccountNamePatterns []string       `yaml:"serviceAccountNamePatterns" json:"serviceAccountNamePatterns,omitempty"`
+	ServiceAccountSelector     *LabelSelector `yaml:"serviceAccountSelector" json:"serviceAccountSelector,omitempty"`
+	// ServiceAccEmailTemplate is rendered with the namespace and name of
+	// service accounts annotated with auto, to give them a GCP service
+	// account that the rule allows without writing out its email
+	ServiceAccEmailTemplate string `yaml:"serviceAccountEmailTemplate" json:"serviceAccountEmailTemplate,omitempty"`
+	// DefaultTTL, MinTTL and MaxTTL override the ttl settings of the
+	// provider for the service accounts that the rule admits
+	DefaultTTL Duration `yaml:"defaultTTL" json:"defaultTTL,omitzero"`
+	MinTTL     Duration `yaml:"minTTL" json:"minTTL,omitzero"`
+	MaxTTL     Duration `yaml:"maxTTL" json:"maxTTL,omitzero"`
+	// AllowedExtraPolicies are patterns matching the policies that the
+	// service accounts which the rule admits can list in their
+	// extra-policies annotation
+	AllowedExtraPolicies []string `yaml:"allowedExtraPolicies" json:"allowedExtraPolicies,omitempty"`
+	// VaultNamespace is the vault namespace that the objects of the
+	// service accounts which the rule admits are written to, instead of
+	// the namespace of the operator
+	VaultNamespace string `yaml:"vaultNamespace" json:"vaultNamespace,omitempty"`
+	// PolicyTemplate replaces the policy of the provider for the service
+	// accounts that the rule admits. It's ignored on access rule
+	// resources.
+	PolicyTemplate string `yaml:"policyTemplate" json:"policyTemplate,omitempty"`
+	// Expression is a CEL expression that must also evaluate to true for
+	// the rule to match. Patterns that aren't set don't restrict a rule
+	// with an expression.
+	Expression string `yaml:"expression" json:"expression,omitempty"`
 }
 
 // GCPOperatorConfig provides configuration when creating a new Operator
@@ -52,11 +94,16 @@ type GCP struct {
 	Path       string
 	Rules      GCPRules
 	tmpl       *template.Template
+
+	// mu guards the rules, ttl settings and policy template, which are
+	// replaced when the config file or the GCPAccessRule resources change
+	mu            sync.RWMutex
+	resourceRules GCPRules
 }
 
 // NewGCPProvider returns a configured GCP provider config
 func NewGCPProvider(config gcpFileConfig) (*GCP, error) {
-	tmpl, err := template.New("policy").Parse(gcpPolicyTemplate)
+	tmpl, err := parseProviderPolicyTemplate(gcpPolicyTemplate, config.PolicyTemplate)
 	if err != nil {
 		return nil, err
 	}
@@ -79,90 +126,243 @@ func (g *GCP) secretIdentityAnnotation() string {
 	return gcpServiceAccountAnnotation
 }
 
-func (g *GCP) secretPath() string {
+func (g *GCP) secretPath(_ string) string {
 	return g.Path + "/static-account/"
 }
 
+func (g *GCP) secretPaths() []string {
+	return []string{g.Path + "/static-account/"}
+}
+
+// vaultNamespaces returns the distinct vault namespaces set by the rules
+func (g *GCP) vaultNamespaces() []string {
+	var vaultNamespaces []string
+	for _, r := range g.rules() {
+		if r.VaultNamespace != "" && !slices.Contains(vaultNamespaces, r.VaultNamespace) {
+			vaultNamespaces = append(vaultNamespaces, r.VaultNamespace)
+		}
+	}
+
+	return vaultNamespaces
+}
+
 func (g *GCP) processUpdateEvent(e event.UpdateEvent) bool {
 	return e.ObjectOld.GetAnnotations()[gcpServiceAccountAnnotation] != e.ObjectNew.GetAnnotations()[gcpServiceAccountAnnotation] ||
 		e.ObjectOld.GetAnnotations()[gcpScopeAnnotation] != e.ObjectNew.GetAnnotations()[gcpScopeAnnotation] ||
 		e.ObjectOld.GetAnnotations()[defaultGCPKeyTTLAnnotation] != e.ObjectNew.GetAnnotations()[defaultGCPKeyTTLAnnotation]
 }
 
-func (g *GCP) secretTTL(serviceAccount *corev1.ServiceAccount) (time.Duration, error) {
-	var err error
+// updateConfig replaces the rules, ttl settings and policy template with those
+// in the provided config
+func (g *GCP) updateConfig(fc *fileConfig) {
+	// The template has been validated when the config was loaded
+	tmpl, err := parseProviderPolicyTemplate(gcpPolicyTemplate, fc.GCP.PolicyTemplate)
+	if err != nil {
+		log.Error(err, "error parsing policy template, keeping the current one", "provider", g.name())
+	}
 
-	secretTTL := g.DefaultTTL
-	if v, ok := serviceAccount.Annotations[defaultGCPKeyTTLAnnotation]; ok {
-		secretTTL, err = time.ParseDuration(v)
-		if err != nil {
-			return 0, fmt.Errorf("error parsing default-gcp-key-ttl %w", err)
-		}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if tmpl != nil {
+		g.tmpl = tmpl
 	}
+	g.DefaultTTL = fc.GCP.DefaultTTL
+	g.Rules = fc.GCP.Rules
+}
 
-	return secretTTL, nil
+// secretTTL returns the ttl in the default-gcp-key-ttl annotation of the
+// service account, or the default ttl, within the bounds of the rule that
+// admits it. The provider itself doesn't bound the ttl.
+func (g *GCP) secretTTL(serviceAccount *corev1.ServiceAccount, rule matchedRule) (time.Duration, error) {
+	g.mu.RLock()
+	bounds := ttlBounds{defaultTTL: g.DefaultTTL}
+	g.mu.RUnlock()
+
+	return bounds.withRule(rule).secretTTL(serviceAccount, defaultGCPKeyTTLAnnotation)
 }
 
-func (g *GCP) secretPayload(serviceAccount *corev1.ServiceAccount) (map[string]interface{}, error) {
-	tokenScopes := serviceAccount.Annotations[gcpScopeAnnotation]
+func (g *GCP) secretPayload(serviceAccount *corev1.ServiceAccount, _ time.Duration) (map[string]interface{}, error) {
+	tokenScopes := parseTokenScopes(serviceAccount.Annotations[gcpScopeAnnotation])
 
-	switch tokenScopes {
-	case "":
+	switch len(tokenScopes) {
+	case 0:
 		return map[string]interface{}{
 			"service_account_email": serviceAccount.Annotations[gcpServiceAccountAnnotation],
 			"secret_type":           "service_account_key",
 		}, nil
 	default:
+		// The scopes are written in the same form as vault returns
+		// them, so that an unchanged account isn't written again
 		return map[string]interface{}{
 			"service_account_email": serviceAccount.Annotations[gcpServiceAccountAnnotation],
 			"secret_type":           "access_token",
-			"token_scopes":          tokenScopes,
+			"token_scopes":          strings.Join(tokenScopes, ","),
 		}, nil
 	}
 }
 
 // renderGCPPolicyTemplate injects the provided name into a policy allowing access
 // to the corresponding GCP secret role
-func (g *GCP) renderPolicyTemplate(name string) (string, error) {
-	var policy bytes.Buffer
-	if err := g.tmpl.Execute(&policy, struct {
-		Path string
-		Name string
-	}{
-		Path: g.Path,
-		Name: name,
-	}); err != nil {
-		return "", err
+func (g *GCP) renderPolicyTemplate(name string, serviceAccount *corev1.ServiceAccount, rule matchedRule) (string, error) {
+	g.mu.RLock()
+	tmpl := g.tmpl
+	g.mu.RUnlock()
+
+	if rule.policyTemplate != "" {
+		var err error
+		if tmpl, err = parsePolicyTemplate(rule.policyTemplate); err != nil {
+			return "", err
+		}
 	}
 
-	return policy.String(), nil
+	return renderPolicy(tmpl, policyTemplateData{
+		Namespace:      serviceAccount.Namespace,
+		ServiceAccount: serviceAccount.Name,
+		Name:           name,
+		Path:           g.Path,
+	})
 }
 
-func (g *GCP) allow(namespace, serviceAccountEmail string) (bool, error) {
-	return g.Rules.allow(namespace, serviceAccountEmail)
+// rules returns the rules from the config file followed by the rules from
+// GCPAccessRule resources
+func (g *GCP) rules() GCPRules {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return append(g.Rules[:len(g.Rules):len(g.Rules)], g.resourceRules...)
+}
+
+// hasRules returns true if there are rules in the config file or from
+// GCPAccessRule resources
+func (g *GCP) hasRules() bool {
+	return len(g.rules()) > 0
+}
+
+func (g *GCP) selectsNamespaces() bool {
+	for _, r := range g.rules() {
+		if r.NamespaceSelector != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *GCP) matchRule(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error) {
+	return g.rules().matchRule(serviceAccount, namespaceLabels)
 }
 
 // allow returns true if there is a rule in the list of rules which allows
 // a service account in the given namespace to assume the given role. Rules are
 // evaluated in order and allow returns true for the first matching rule in the
 // list
-func (gcr GCPRules) allow(namespace, serviceAccountEmail string) (bool, error) {
-	err := validateServiceAccountEmail(serviceAccountEmail)
+func (gcr GCPRules) allow(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (bool, error) {
+	i, err := gcr.match(serviceAccount, namespaceLabels)
 	if err != nil {
 		return false, err
 	}
 
-	for _, r := range gcr {
-		allowed, err := r.allows(namespace, serviceAccountEmail)
+	if i >= 0 || len(gcr) > 0 {
+		return i >= 0, nil
+	}
+
+	// Without rules there isn't a template to render an email from, or
+	// patterns to allow extra policies
+	if err := checkExtraPolicies(serviceAccount, nil); err != nil {
+		return false, err
+	}
+
+	return serviceAccount.Annotations[gcpServiceAccountAnnotation] != autoIdentity, nil
+}
+
+// match returns the index of the first rule in the list which allows the
+// service account to use the GCP service account in its annotation, or -1 if
+// none of them do. A service account annotated with auto is matched by the
+// first rule that allows the email rendered from its template.
+func (gcr GCPRules) match(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (int, error) {
+	if serviceAccount.Annotations[gcpServiceAccountAnnotation] == autoIdentity {
+		return gcr.matchTemplate(serviceAccount, namespaceLabels)
+	}
+
+	serviceAccountEmail := serviceAccount.Annotations[gcpServiceAccountAnnotation]
+	err := validateServiceAccountEmail(serviceAccountEmail)
+	if err != nil {
+		return -1, err
+	}
+
+	for i, r := range gcr {
+		allowed, err := r.allows(serviceAccount, namespaceLabels, serviceAccountEmail)
 		if err != nil {
-			return false, err
+			return -1, err
 		}
 		if allowed {
-			return true, nil
+			return i, nil
 		}
 	}
 
-	return len(gcr) == 0, nil
+	return -1, nil
+}
+
+// matchTemplate returns the index of the first rule in the list with an email
+// template which allows the service account to use the rendered GCP service
+// account, or -1 if none of them do
+func (gcr GCPRules) matchTemplate(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (int, error) {
+	for i, r := range gcr {
+		if r.ServiceAccEmailTemplate == "" {
+			continue
+		}
+
+		serviceAccountEmail, err := renderIdentityTemplate(r.ServiceAccEmailTemplate, serviceAccount)
+		if err != nil {
+			return -1, err
+		}
+		if err := validateServiceAccountEmail(serviceAccountEmail); err != nil {
+			return -1, fmt.Errorf("invalid email rendered from serviceAccountEmailTemplate: %w", err)
+		}
+
+		allowed, err := r.allows(serviceAccount, namespaceLabels, serviceAccountEmail)
+		if err != nil {
+			return -1, err
+		}
+		if allowed {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// matchRule returns the first rule in the list which allows the service
+// account, with the GCP service account in its annotation or the email
+// rendered from the template of the rule if it's annotated with auto
+func (gcr GCPRules) matchRule(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error) {
+	rule := matchedRule{index: -1, identity: serviceAccount.Annotations[gcpServiceAccountAnnotation]}
+
+	i, err := gcr.match(serviceAccount, namespaceLabels)
+	if err != nil {
+		return rule, err
+	}
+	if i < 0 {
+		rule.allowed, err = gcr.allow(serviceAccount, namespaceLabels)
+		return rule, err
+	}
+
+	r := gcr[i]
+	if rule.identity == autoIdentity {
+		if rule.identity, err = renderIdentityTemplate(r.ServiceAccEmailTemplate, serviceAccount); err != nil {
+			return rule, err
+		}
+	}
+	rule.index = i
+	rule.allowed = true
+	rule.defaultTTL = r.DefaultTTL
+	rule.minTTL = r.MinTTL
+	rule.maxTTL = r.MaxTTL
+	rule.policyTemplate = r.PolicyTemplate
+	rule.vaultNamespace = r.VaultNamespace
+
+	return rule, nil
 }
 
 func validateServiceAccountEmail(email string) error {
@@ -177,9 +377,21 @@ func validateServiceAccountEmail(email string) error {
 	return nil
 }
 
-// allows checks whether this rule allows a namespace to assume the given role_arn
-func (gcr *GCPRule) allows(namespace string, serviceAccountEmail string) (bool, error) {
-	namespaceAllowed, err := matchesNamespace(namespace, gcr.NamespacePatterns)
+// allows checks whether this rule allows a service account in a namespace with
+// the given labels to use the given GCP service account
+func (gcr *GCPRule) allows(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string, serviceAccountEmail string) (bool, error) {
+	namespaceAllowed, err := matchesNamespace(serviceAccount.Namespace, gcr.NamespacePatterns)
+	if err != nil {
+		return false, err
+	}
+	namespaceAllowed = namespaceAllowed || (len(gcr.NamespacePatterns) == 0 && (gcr.NamespaceSelector != nil || gcr.Expression != ""))
+
+	selectorAllowed, err := gcr.NamespaceSelector.matches(namespaceLabels)
+	if err != nil {
+		return false, err
+	}
+
+	kubeServiceAccountAllowed, err := gcr.matchesServiceAccount(serviceAccount)
 	if err != nil {
 		return false, err
 	}
@@ -188,8 +400,139 @@ func (gcr *GCPRule) allows(namespace string, serviceAccountEmail string) (bool,
 	if err != nil {
 		return false, err
 	}
+	serviceAccountAllowed = serviceAccountAllowed || (len(gcr.ServiceAccEmailPatterns) == 0 && gcr.Expression != "")
+
+	projectAllowed := gcr.matchesProjectID(gcpProject(serviceAccountEmail))
+
+	if !namespaceAllowed || !selectorAllowed || !kubeServiceAccountAllowed || !serviceAccountAllowed || !projectAllowed {
+		return false, nil
+	}
+	if gcr.Expression != "" {
+		allowed, err := evalExpression("gcp", gcr.Expression, serviceAccount, gcpExpressionVars(serviceAccountEmail))
+		if err != nil || !allowed {
+			return false, err
+		}
+	}
+
+	// The rule that allows the GCP service account decides the scopes and
+	// the extra policies, so a scope or policy that it doesn't allow is an
+	// error rather than a reason to try the next rule
+	if err := gcr.checkScopes(serviceAccount.Annotations[gcpScopeAnnotation]); err != nil {
+		return true, err
+	}
+
+	return true, checkExtraPolicies(serviceAccount, gcr.AllowedExtraPolicies)
+}
+
+// matchesProjectID returns true if the rule allows the project, or if it
+// doesn't contain any project IDs at all
+func (gcr *GCPRule) matchesProjectID(project string) bool {
+	for _, id := range gcr.ProjectIDs {
+		if id == project {
+			return true
+		}
+	}
+
+	return len(gcr.ProjectIDs) == 0
+}
+
+// checkScopes returns an error if any of the comma separated token scopes
+// isn't allowed by the rule, or if there aren't any, since a service account
+// key can be used with any scope
+func (gcr *GCPRule) checkScopes(tokenScopes string) error {
+	if len(gcr.AllowedScopes) == 0 {
+		return nil
+	}
+
+	scopes := parseTokenScopes(tokenScopes)
+	if len(scopes) == 0 {
+		return fmt.Errorf("token scopes must be requested in %s, the allowed scopes are %s", gcpScopeAnnotation, strings.Join(gcr.AllowedScopes, ","))
+	}
+
+	var denied []string
+	for _, scope := range scopes {
+		if !slices.Contains(gcr.AllowedScopes, scope) {
+			denied = append(denied, scope)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("token scopes %s aren't allowed, the allowed scopes are %s", strings.Join(denied, ","), strings.Join(gcr.AllowedScopes, ","))
+	}
+
+	return nil
+}
+
+// parseTokenScopes returns the comma separated scopes in the token scopes
+// annotation, without the spaces around them or empty ones
+func parseTokenScopes(tokenScopes string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(tokenScopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
+
+// gcpProject returns the project of a GCP service account, which is empty for
+// service accounts that don't have the project in their email, like the
+// compute engine default service account
+func gcpProject(serviceAccountEmail string) string {
+	name, domain, ok := strings.Cut(serviceAccountEmail, "@")
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case strings.HasSuffix(domain, ".iam.gserviceaccount.com"):
+		return strings.TrimSuffix(domain, ".iam.gserviceaccount.com")
+	case domain == "appspot.gserviceaccount.com":
+		return name
+	default:
+		return ""
+	}
+}
+
+// matchesServiceAccount returns true if the rule allows the name and labels of
+// the kubernetes service account
+func (gcr *GCPRule) matchesServiceAccount(serviceAccount *corev1.ServiceAccount) (bool, error) {
+	nameAllowed, err := matchesServiceAccountName(serviceAccount.Name, gcr.ServiceAccountNamePatterns)
+	if err != nil || !nameAllowed {
+		return false, err
+	}
+
+	return gcr.ServiceAccountSelector.matches(serviceAccount.Labels)
+}
 
-	return namespaceAllowed && serviceAccountAllowed, nil
+// validate checks that the selectors and the email and policy templates of the
+// rule can be parsed and that its expression compiles
+func (gcr *GCPRule) validate() error {
+	if err := gcr.NamespaceSelector.validate("namespaceSelector"); err != nil {
+		return err
+	}
+	if err := gcr.ServiceAccountSelector.validate("serviceAccountSelector"); err != nil {
+		return err
+	}
+	if _, err := parseIdentityTemplate(gcr.ServiceAccEmailTemplate); err != nil {
+		return fmt.Errorf("invalid serviceAccountEmailTemplate: %w", err)
+	}
+	if err := validateTTLs(gcr.DefaultTTL, gcr.MinTTL, gcr.MaxTTL, 0, 0); err != nil {
+		return err
+	}
+	if gcr.PolicyTemplate != "" {
+		if _, err := parsePolicyTemplate(gcr.PolicyTemplate); err != nil {
+			return fmt.Errorf("invalid policyTemplate: %w", err)
+		}
+	}
+	if gcr.Expression == "" {
+		return nil
+	}
+	if _, err := compileExpression("gcp", gcr.Expression); err != nil {
+		return fmt.Errorf("invalid expression: %w", err)
+	}
+
+	return nil
 }
 
 // matchesServiceAccountEmail returns true if the rule allows the given service account
@@ -2,8 +2,11 @@ package operator
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
@@ -19,16 +22,16 @@ func TestGCPOperatorAdmitEvent(t *testing.T) {
 	o, _ := NewOperator(config, gcp)
 
 	// Test that without any rules any valid event is admitted
-	assert.True(t, o.admitEvent("foobar", "foo@bar.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "foo@bar.gserviceaccount.com")))
 
 	// Test that an empty service account is not admitted
-	assert.False(t, o.admitEvent("foobar", ""))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "")))
 
 	// Test that an invalid service account is not admitted
-	assert.False(t, o.admitEvent("foobar", "foobar"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "foobar")))
 
 	// Test that a malformed service account is not admitted (not a gserviceaccount.com email)
-	assert.False(t, o.admitEvent("foobar", "foo@bar.baz.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "foo@bar.baz.com")))
 
 	gcp.Rules = GCPRules{
 		GCPRule{
@@ -62,33 +65,175 @@ func TestGCPOperatorAdmitEvent(t *testing.T) {
 	}
 
 	// Test foo foo@bar.iam.gserviceaccount.com is allowd
-	assert.True(t, o.admitEvent("foo", "foo@bar.iam.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
 
 	// Test bar-* foo@bar.iam.gserviceaccount.com is allowd
-	assert.True(t, o.admitEvent("bar-foo", "foo@bar.iam.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar-foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "bar@bar.iam.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", gcpServiceAccountAnnotation, "bar@bar.iam.gserviceaccount.com")))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "bar-baz@bar.iam.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("kube-system", gcpServiceAccountAnnotation, "bar-baz@bar.iam.gserviceaccount.com")))
 
 	// Test the ? match
-	assert.True(t, o.admitEvent("system", "bar-foo@bar.iam.gserviceaccount.com"))
+	assert.True(t, o.admitEvent(annotatedServiceAccount("system", gcpServiceAccountAnnotation, "bar-foo@bar.iam.gserviceaccount.com")))
 
 	// Test that baz foo@bar.iam.gserviceaccount.com is not allowed
-	assert.False(t, o.admitEvent("baz", "foo@bar.iam.gserviceaccount.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("baz", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
 
 	// Test that the matching doesn't match the namespace foo to foobar as a
 	// substring
-	assert.False(t, o.admitEvent("foobar", "foo@bar.iam.gserviceaccount.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
 
 	// Test that the rules don't mix
-	assert.False(t, o.admitEvent("foo", "baz@bar.iam.gserviceaccount.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "baz@bar.iam.gserviceaccount.com")))
 
 	// Test that a rule without a namespace pattern does not admit
-	assert.False(t, o.admitEvent("foo", "baz@bar.iam.gserviceaccount.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "baz@bar.iam.gserviceaccount.com")))
 
 	// Test that a rule without a service account email pattern does not admit
-	assert.False(t, o.admitEvent("foobar", "baz@bar.iam.gserviceaccount.com"))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("foobar", gcpServiceAccountAnnotation, "baz@bar.iam.gserviceaccount.com")))
+}
+
+// TestGCPOperatorAdmitEventExpression tests that rule expressions are evaluated
+// along with the patterns
+func TestGCPOperatorAdmitEventExpression(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	gcp, _ := NewGCPProvider(fc.GCP)
+	o, _ := NewOperator(config, gcp)
+
+	gcp.Rules = GCPRules{
+		GCPRule{
+			ServiceAccEmailPatterns: []string{
+				"*@*.iam.gserviceaccount.com",
+			},
+			Expression: `project == serviceAccount.namespace && email.startsWith(serviceAccount.name + "@")`,
+		},
+	}
+
+	// Test that the expression can refer to the project and email
+	assert.True(t, o.admitEvent(annotatedServiceAccount("bar", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("baz", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", gcpServiceAccountAnnotation, "baz@bar.iam.gserviceaccount.com")))
+
+	// Test that the patterns are still applied with an expression
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", gcpServiceAccountAnnotation, "bar@appspot.gserviceaccount.com")))
+}
+
+// TestGCPOperatorAdmitEventServiceAccount tests that rules can be narrowed to
+// service accounts by their names and labels
+func TestGCPOperatorAdmitEventServiceAccount(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	gcp, _ := NewGCPProvider(fc.GCP)
+	o, _ := NewOperator(config, gcp)
+
+	gcp.Rules = GCPRules{
+		GCPRule{
+			NamespacePatterns:          []string{"foo"},
+			ServiceAccEmailPatterns:    []string{"*@bar.iam.gserviceaccount.com"},
+			ServiceAccountNamePatterns: []string{"foo", "bar-*"},
+			ServiceAccountSelector: &LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: "restricted", Operator: metav1.LabelSelectorOpDoesNotExist},
+				},
+			},
+		},
+	}
+
+	serviceAccount := annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+
+	// Test that the name must match the patterns
+	assert.True(t, o.admitEvent(serviceAccount))
+	serviceAccount.Name = "baz"
+	assert.False(t, o.admitEvent(serviceAccount))
+	serviceAccount.Name = "bar-baz"
+	assert.True(t, o.admitEvent(serviceAccount))
+
+	// Test that the labels must match the selector
+	serviceAccount.Labels = map[string]string{"restricted": "true"}
+	assert.False(t, o.admitEvent(serviceAccount))
+}
+
+// TestGCPOperatorAdmitEventProjectsAndScopes tests that rules restrict the
+// projects of GCP service accounts and the token scopes they can request
+func TestGCPOperatorAdmitEventProjectsAndScopes(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	gcp, _ := NewGCPProvider(fc.GCP)
+	o, _ := NewOperator(config, gcp)
+
+	gcp.Rules = GCPRules{
+		GCPRule{
+			NamespacePatterns:       []string{"foo"},
+			ServiceAccEmailPatterns: []string{"*"},
+			ProjectIDs:              []string{"bar", "baz"},
+			AllowedScopes: []string{
+				"https://www.googleapis.com/auth/cloud-platform.read-only",
+				"https://www.googleapis.com/auth/devstorage.read_only",
+			},
+		},
+	}
+
+	scopedServiceAccount := func(email string) *corev1.ServiceAccount {
+		serviceAccount := annotatedServiceAccount("foo", gcpServiceAccountAnnotation, email)
+		serviceAccount.Annotations[gcpScopeAnnotation] = "https://www.googleapis.com/auth/cloud-platform.read-only"
+		return serviceAccount
+	}
+
+	// Test that the project is parsed from the email
+	assert.True(t, o.admitEvent(scopedServiceAccount("foo@bar.iam.gserviceaccount.com")))
+	assert.True(t, o.admitEvent(scopedServiceAccount("baz@appspot.gserviceaccount.com")))
+	assert.False(t, o.admitEvent(scopedServiceAccount("foo@qux.iam.gserviceaccount.com")))
+	assert.False(t, o.admitEvent(scopedServiceAccount("000000000000-compute@developer.gserviceaccount.com")))
+
+	// Test that the allowed scopes can be requested
+	serviceAccount := annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+	serviceAccount.Annotations[gcpScopeAnnotation] = "https://www.googleapis.com/auth/cloud-platform.read-only, https://www.googleapis.com/auth/devstorage.read_only"
+	assert.True(t, o.admitEvent(serviceAccount))
+
+	// Test that a service account key, which can be used with any scope,
+	// is denied when the rule restricts the scopes
+	unscoped := annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+	assert.False(t, o.admitEvent(unscoped))
+	assert.Equal(t, "vault.uw.systems/gcp-service-account foo@bar.iam.gserviceaccount.com was denied by gcp.rules: token scopes must be requested in vault.uw.systems/gcp-token-scopes, the allowed scopes are https://www.googleapis.com/auth/cloud-platform.read-only,https://www.googleapis.com/auth/devstorage.read_only", o.deniedReason(unscoped))
+
+	// Test that a scope outside of the allowed scopes is denied with a
+	// reason
+	serviceAccount.Annotations[gcpScopeAnnotation] = "https://www.googleapis.com/auth/cloud-platform.read-only,https://www.googleapis.com/auth/cloud-platform"
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/gcp-service-account foo@bar.iam.gserviceaccount.com was denied by gcp.rules: token scopes https://www.googleapis.com/auth/cloud-platform aren't allowed, the allowed scopes are https://www.googleapis.com/auth/cloud-platform.read-only,https://www.googleapis.com/auth/devstorage.read_only", o.deniedReason(serviceAccount))
+}
+
+// TestGCPSecretPayload tests that the token scopes are written without spaces,
+// so that they're equal to the scopes that vault returns for the account
+func TestGCPSecretPayload(t *testing.T) {
+	gcp, _ := NewGCPProvider(defaultFileConfig.GCP)
+
+	serviceAccount := annotatedServiceAccount("foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+	payload, err := gcp.secretPayload(serviceAccount, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"service_account_email": "foo@bar.iam.gserviceaccount.com",
+		"secret_type":           "service_account_key",
+	}, payload)
+
+	serviceAccount.Annotations[gcpScopeAnnotation] = " https://www.googleapis.com/auth/cloud-platform.read-only, https://www.googleapis.com/auth/devstorage.read_only,"
+	payload, err = gcp.secretPayload(serviceAccount, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"service_account_email": "foo@bar.iam.gserviceaccount.com",
+		"secret_type":           "access_token",
+		"token_scopes":          "https://www.googleapis.com/auth/cloud-platform.read-only,https://www.googleapis.com/auth/devstorage.read_only",
+	}, payload)
+	assert.Empty(t, diffVaultData(map[string]interface{}{
+		"service_account_email": "foo@bar.iam.gserviceaccount.com",
+		"secret_type":           "access_token",
+		"token_scopes": []interface{}{
+			"https://www.googleapis.com/auth/cloud-platform.read-only",
+			"https://www.googleapis.com/auth/devstorage.read_only",
+		},
+	}, payload))
 }
@@ -0,0 +1,56 @@
+package operator
+
+import (
+	"bytes"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// autoIdentity is the value of an identity annotation that opts a service
+// account in to the identity rendered from the template of the first rule
+// which allows it
+const autoIdentity = "auto"
+
+// parseIdentityTemplate parses the role or email template of a rule
+func parseIdentityTemplate(text string) (*template.Template, error) {
+	return template.New("identity").Option("missingkey=error").Parse(text)
+}
+
+// renderIdentityTemplate renders the role or email template of a rule with the
+// namespace and name of the service account
+func renderIdentityTemplate(text string, serviceAccount *corev1.ServiceAccount) (string, error) {
+	tmpl, err := parseIdentityTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	var identity bytes.Buffer
+	if err := tmpl.Execute(&identity, struct {
+		Namespace string
+		Name      string
+	}{
+		Namespace: serviceAccount.Namespace,
+		Name:      serviceAccount.Name,
+	}); err != nil {
+		return "", err
+	}
+
+	return identity.String(), nil
+}
+
+// resolveIdentity returns the service account with the identity that the rule
+// which admits it resolves for it. A templated identity is rendered into a
+// copy of the service account, so that the annotation isn't patched along with
+// the status.
+func (o *Operator) resolveIdentity(serviceAccount *corev1.ServiceAccount, rule matchedRule) *corev1.ServiceAccount {
+	annotation := o.provider.secretIdentityAnnotation()
+	if serviceAccount.Annotations[annotation] != autoIdentity {
+		return serviceAccount
+	}
+
+	resolved := serviceAccount.DeepCopy()
+	resolved.Annotations[annotation] = rule.identity
+
+	return resolved
+}
@@ -0,0 +1,116 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestResolveIdentity tests that service accounts annotated with auto are
+// given the identity rendered from the template of the first rule that allows
+// it, without changing their annotations
+func TestResolveIdentity(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+		AWSRule{
+			NamespacePatterns: []string{"bar"},
+			RoleNamePatterns:  []string{"foo-*"},
+			RoleTemplate:      "arn:aws:iam::111111111111:role/{{ .Namespace }}-{{ .Name }}",
+		},
+		AWSRule{
+			NamespacePatterns: []string{"*"},
+			RoleNamePatterns:  []string{"*/*"},
+			AccountIDs:        []string{"222222222222"},
+			RoleTemplate:      "arn:aws:iam::222222222222:role/{{ .Namespace }}/{{ .Name }}",
+		},
+	}
+	o, _ := NewOperator(&Config{}, aws)
+
+	// Test that the rendered role is validated by the rule with the
+	// template, so the second rule doesn't allow its own role
+	serviceAccount := annotatedServiceAccount("bar", awsRoleAnnotation, autoIdentity)
+	assert.True(t, o.admitEvent(serviceAccount))
+	resolved := o.resolveIdentity(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.Equal(t, "arn:aws:iam::222222222222:role/bar/foo", resolved.Annotations[awsRoleAnnotation])
+	assert.Equal(t, autoIdentity, serviceAccount.Annotations[awsRoleAnnotation])
+
+	result := o.check(serviceAccount, nil)
+	assert.True(t, result.OK())
+	assert.Equal(t, 2, result.Rule)
+	assert.Equal(t, "arn:aws:iam::222222222222:role/bar/foo", result.Identity)
+	assert.Equal(t, []string{"arn:aws:iam::222222222222:role/bar/foo"}, result.Payload["role_arns"])
+
+	// Test that service accounts with a role aren't changed
+	serviceAccount = annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo-role")
+	resolved = o.resolveIdentity(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.Same(t, serviceAccount, resolved)
+
+	// Test that auto isn't allowed without a rule with a template
+	aws.Rules = AWSRules{}
+	assert.False(t, o.admitEvent(annotatedServiceAccount("bar", awsRoleAnnotation, autoIdentity)))
+
+	gcp, _ := NewGCPProvider(defaultFileConfig.GCP)
+	gcp.Rules = GCPRules{
+		GCPRule{
+			NamespacePatterns:       []string{"foo"},
+			ServiceAccEmailPatterns: []string{"foo-*@bar.iam.gserviceaccount.com"},
+			ServiceAccEmailTemplate: "{{ .Namespace }}-{{ .Name }}@bar.iam.gserviceaccount.com",
+		},
+	}
+	o, _ = NewOperator(&Config{}, gcp)
+
+	serviceAccount = annotatedServiceAccount("foo", gcpServiceAccountAnnotation, autoIdentity)
+	resolved = o.resolveIdentity(serviceAccount, matchRule(t, gcp, serviceAccount))
+	assert.Equal(t, "foo-foo@bar.iam.gserviceaccount.com", resolved.Annotations[gcpServiceAccountAnnotation])
+
+	// Test that a namespace that the rule doesn't allow isn't given an
+	// identity
+	serviceAccount = annotatedServiceAccount("bar", gcpServiceAccountAnnotation, autoIdentity)
+	assert.False(t, o.admitEvent(serviceAccount))
+	rule := matchRule(t, gcp, serviceAccount)
+	assert.Equal(t, -1, rule.index)
+	assert.Equal(t, autoIdentity, rule.identity)
+}
+
+// TestResolveIdentityRule tests that a service account annotated with auto is
+// reconciled with the settings of the rule whose template resolved its
+// identity, even when an earlier rule allows the resolved identity
+func TestResolveIdentityRule(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"*"},
+			RoleNamePatterns:  []string{"*"},
+			AccountIDs:        []string{"111111111111"},
+			MaxTTL:            Duration{time.Hour},
+			PolicyTemplate: `
+path "kv/data/{{ .Namespace }}/*" {
+  capabilities = ["read"]
+}
+`,
+			VaultNamespace: "first",
+		},
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+			AccountIDs:        []string{"111111111111"},
+			RoleTemplate:      "arn:aws:iam::111111111111:role/{{ .Namespace }}-{{ .Name }}",
+			DefaultTTL:        Duration{2 * time.Hour},
+			VaultNamespace:    "second",
+		},
+	}
+	o, _ := NewOperator(&Config{}, aws)
+
+	result := o.check(annotatedServiceAccount("foo", awsRoleAnnotation, autoIdentity), nil)
+	assert.True(t, result.OK())
+	assert.Equal(t, 1, result.Rule)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/foo-foo", result.Identity)
+	assert.Equal(t, 2*time.Hour, result.TTL)
+	assert.Equal(t, "second", result.VaultNamespace)
+	assert.NotContains(t, result.Policy, "kv/data")
+}
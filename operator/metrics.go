@@ -0,0 +1,107 @@
+package operator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	promNamespace = "vkcc"
+	promSubsystem = "operator"
+)
+
+// Results of a reconcile
+const (
+	reconcileResultWritten = "written"
+	reconcileResultDeleted = "deleted"
+	reconcileResultDenied  = "denied"
+	reconcileResultError   = "error"
+)
+
+// Results of a garbage collection
+const (
+	garbageCollectionResultSuccess = "success"
+	garbageCollectionResultError   = "error"
+)
+
+// Results of writing an object to vault
+const (
+	vaultWriteResultApplied = "applied"
+	vaultWriteResultSkipped = "skipped"
+)
+
+var (
+	promReconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "reconciles_total"),
+		Help: "Total count of serviceaccount reconciles, by provider and result",
+	},
+		[]string{"provider", "result"},
+	)
+	promDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "denials_total"),
+		Help: "Total count of serviceaccount annotations denied by the rules, by provider and namespace",
+	},
+		[]string{"provider", "namespace"},
+	)
+	promGarbageCollected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "garbage_collected_total"),
+		Help: "Total count of orphaned serviceaccounts removed from Vault by garbage collection, by provider",
+	},
+		[]string{"provider"},
+	)
+	promGarbageCollections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "garbage_collections_total"),
+		Help: "Total count of garbage collection runs, by provider and result",
+	},
+		[]string{"provider", "result"},
+	)
+	promLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "leader"),
+		Help: "Whether this replica is reconciling serviceaccounts, either as the elected leader or because leader election is disabled",
+	})
+	promManagedServiceAccounts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "managed_serviceaccounts"),
+		Help: "Number of serviceaccounts that have been written to Vault, by provider",
+	},
+		[]string{"provider"},
+	)
+	promVaultWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_writes_total"),
+		Help: "Total count of objects written to Vault or skipped because they were unchanged, by provider and result",
+	},
+		[]string{"provider", "result"},
+	)
+	promVaultRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_requests_total"),
+		Help: "Total count of requests to Vault, by provider, code and method",
+	},
+		[]string{"provider", "code", "method"},
+	)
+	promVaultRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_in_flight_requests"),
+		Help: "Number of requests to Vault currently in-flight, by provider",
+	},
+		[]string{"provider"},
+	)
+	promVaultRequestsDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_request_duration_seconds"),
+		Help: "A histogram of request latencies to Vault, by provider",
+	},
+		[]string{"provider"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		promReconciles,
+		promDenials,
+		promGarbageCollected,
+		promGarbageCollections,
+		promLeader,
+		promManagedServiceAccounts,
+		promVaultWrites,
+		promVaultRequests,
+		promVaultRequestsInFlight,
+		promVaultRequestsDuration,
+	)
+}
@@ -2,19 +2,58 @@ package operator
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+	vault "github.com/hashicorp/vault/api"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 
 	// Enables all auth methods for the kube client
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Reasons for the events emitted on service accounts
+const (
+	reasonWritten           = "VaultWritten"
+	reasonRemoved           = "VaultRemoved"
+	reasonDenied            = "Denied"
+	reasonInvalidTTL        = "InvalidTTL"
+	reasonInvalidAnnotation = "InvalidAnnotation"
+	reasonVaultError        = "VaultError"
+)
+
+// Status annotations maintained on service accounts, which are prefixed with
+// the name of the provider
+const (
+	vaultRoleStatusAnnotation  = "vault-role"
+	lastSyncedStatusAnnotation = "last-synced"
+	syncStatusStatusAnnotation = "sync-status"
+	syncErrorStatusAnnotation  = "sync-error"
+	// vaultNamespaceStatusAnnotation is the vault namespace that the
+	// objects were written to, when it isn't the default one
+	vaultNamespaceStatusAnnotation = "vault-namespace"
+
+	syncStatusSynced = "Synced"
+	syncStatusDenied = "Denied"
+	syncStatusError  = "Error"
 )
 
 // Operator is responsible for creating Kubernetes auth roles and vault AWS
@@ -23,80 +62,154 @@ type Operator struct {
 	*Config
 	log logr.Logger
 	provider
+
+	// reconcileAll triggers a reconcile of every annotated service account
+	reconcileAll chan event.GenericEvent
+
+	// managed are the service accounts that have been written to vault,
+	// which are counted by the managed serviceaccounts gauge.
+	// accessRulesLoaded is whether the access rule resources have been
+	// loaded, when they're watched.
+	// knownVaultNamespaces are the vault namespaces that objects may have
+	// been written to, which are kept after the rules that set them have
+	// changed, so that the objects in them are still removed.
+	mu                   sync.Mutex
+	managed              map[types.NamespacedName]bool
+	accessRulesLoaded    bool
+	knownVaultNamespaces map[string]bool
+
+	// readDenied logs that vault denied reading an object only once
+	readDenied sync.Once
 }
 
 type provider interface {
-	allow(namespace, roleArn string) (bool, error)
+	accessRule() client.Object
+	hasRules() bool
+	loadAccessRules(ctx context.Context, c client.Reader) error
+	// matchRule returns the rule that admits the service account, which
+	// decides its identity, ttl, policy and vault namespace
+	matchRule(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error)
+	// selectsNamespaces returns true if any of the rules select
+	// namespaces by their labels
+	selectsNamespaces() bool
+	updateConfig(fc *fileConfig)
 	name() string
 	processUpdateEvent(e event.UpdateEvent) bool
-	renderPolicyTemplate(name string) (string, error)
+	renderPolicyTemplate(name string, serviceAccount *corev1.ServiceAccount, rule matchedRule) (string, error)
 	secretIdentityAnnotation() string
-	secretPath() string
-	secretTTL(serviceAccount *corev1.ServiceAccount) (time.Duration, error)
-	secretPayload(serviceAccount *corev1.ServiceAccount) (map[string]interface{}, error)
+	// secretPath is the path that the secret identity is written under
+	// and secretPaths are all of the paths that they can be written under
+	secretPath(identity string) string
+	secretPaths() []string
+	// vaultNamespaces are the vault namespaces of all of the rules
+	vaultNamespaces() []string
+	secretTTL(serviceAccount *corev1.ServiceAccount, rule matchedRule) (time.Duration, error)
+	secretPayload(serviceAccount *corev1.ServiceAccount, secretTTL time.Duration) (map[string]interface{}, error)
+}
+
+// matchedRule is the rule that admits a service account. It's matched once
+// for each reconcile, so that the identity, ttl, policy and vault namespace of
+// a service account all come from the same rule, even if the rules change in
+// the meantime.
+type matchedRule struct {
+	// index is the index of the rule, or -1 if none of the rules admit
+	// the service account, which is also the case when there are no rules
+	index   int
+	allowed bool
+	// identity is the identity in the annotation of the service account,
+	// or the identity rendered from the template of the rule if it's
+	// annotated with auto
+	identity       string
+	defaultTTL     Duration
+	minTTL         Duration
+	maxTTL         Duration
+	policyTemplate string
+	vaultNamespace string
 }
 
 // NewOperator returns a configured Operator
 func NewOperator(config *Config, provider provider) (*Operator, error) {
 	o := &Operator{
-		Config:   config,
-		log:      log.WithName(provider.name()),
-		provider: provider,
+		Config:       config,
+		log:          log.WithName(provider.name()),
+		provider:     provider,
+		reconcileAll: make(chan event.GenericEvent, 1),
+		managed:      map[types.NamespacedName]bool{},
+
+		knownVaultNamespaces: map[string]bool{},
 	}
 
 	return o, nil
 }
 
+// NeedLeaderElection ensures that garbage collection is only performed by the
+// elected leader when leader election is enabled
+func (o *Operator) NeedLeaderElection() bool {
+	return true
+}
+
 // Start is ran when the manager starts up. We're using it to clear up orphaned
-// serviceaccounts that could have been missed while the operator was down
+// serviceaccounts that could have been missed while the operator was down, and
+// then to garbage collect and repair drift periodically until the manager
+// stops. Errors are logged rather than returned, so that they don't stop the
+// operator.
 func (o *Operator) Start(ctx context.Context) error {
-	o.log.Info("garbage collection started")
+	o.collectGarbage(ctx)
 
-	// AWS secret roles or GCP static accounts
-	secretList, err := o.VaultClient.Logical().List(o.provider.secretPath())
-	if err != nil {
-		return err
+	var garbageCollection, driftRepair <-chan time.Time
+	if o.GarbageCollectionInterval > 0 {
+		ticker := time.NewTicker(o.GarbageCollectionInterval)
+		defer ticker.Stop()
+		garbageCollection = ticker.C
 	}
-	if secretList != nil {
-		if keys, ok := secretList.Data["keys"].([]interface{}); ok {
-			err = o.garbageCollect(keys)
-			if err != nil {
-				return err
-			}
-		}
+	if o.DriftRepairInterval > 0 {
+		ticker := time.NewTicker(o.DriftRepairInterval)
+		defer ticker.Stop()
+		driftRepair = ticker.C
 	}
 
-	// Kubernetes auth roles
-	kubeAuthRoleList, err := o.VaultClient.Logical().List("auth/" + o.KubernetesAuthBackend + "/role/")
-	if err != nil {
-		return err
-	}
-	if kubeAuthRoleList != nil {
-		if keys, ok := kubeAuthRoleList.Data["keys"].([]interface{}); ok {
-			err = o.garbageCollect(keys)
-			if err != nil {
-				return err
-			}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-garbageCollection:
+			o.collectGarbage(ctx)
+		case <-driftRepair:
+			// Reconciles only write the objects that differ from
+			// what the operator would write, so reconciling every
+			// service account rewrites those that were changed
+			// outside of the operator
+			o.log.Info("drift repair started")
+			o.triggerReconcileAll()
 		}
 	}
+}
 
-	// Policies
-	policies, err := o.VaultClient.Logical().List("sys/policy")
-	if err != nil {
-		return err
-	}
-	if policies != nil {
-		if keys, ok := policies.Data["keys"].([]interface{}); ok {
-			err = o.garbageCollect(keys)
-			if err != nil {
-				return err
-			}
+// collectGarbage runs a garbage collection and logs its outcome
+func (o *Operator) collectGarbage(ctx context.Context) {
+	result := garbageCollectionResultError
+	defer func() {
+		promGarbageCollections.WithLabelValues(o.provider.name(), result).Inc()
+	}()
+
+	// Make sure that the access rule resources are loaded, otherwise
+	// service accounts they allow would be garbage collected
+	if o.WatchAccessRules {
+		if err := o.loadAccessRules(ctx); err != nil {
+			o.log.Error(err, "error loading access rules, skipping garbage collection")
+			return
 		}
 	}
 
-	o.log.Info("garbage collection finished")
+	o.log.Info("garbage collection started")
 
-	return nil
+	if err := o.garbageCollect(ctx); err != nil {
+		o.log.Error(err, "garbage collection failed")
+		return
+	}
+	result = garbageCollectionResultSuccess
+
+	o.log.Info("garbage collection finished")
 }
 
 // Reconcile ensures that a ServiceAccount is able to login at
@@ -107,67 +220,384 @@ func (o *Operator) Start(ctx context.Context) error {
 // For GCP at gcp/static-account/<prefix>_gcp_<namespace>_<name> for the GCP
 // service account specified in vault.uw.systems/gcp-service-account annotation
 func (o *Operator) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	result := reconcileResultError
+	defer func() {
+		promReconciles.WithLabelValues(o.provider.name(), result).Inc()
+	}()
+
 	// Reload vault configuration from the environment, this is primarily
 	// done to pick up CA cert rotations
 	if err := o.VaultConfig.ReadEnvironment(); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	// The access rule resources are loaded before the first reconcile,
+	// otherwise the service accounts they allow would be denied and
+	// removed from vault
+	if o.WatchAccessRules && !o.isAccessRulesLoaded() {
+		if err := o.loadAccessRules(ctx); err != nil {
+			return ctrl.Result{}, fmt.Errorf("error loading access rules: %w", err)
+		}
+	}
+
 	// Check if the service account exists. If it doesn't then it's been
 	// deleted and we can remove it from vault
 	del := false
+	exists := true
 	serviceAccount := &corev1.ServiceAccount{}
 	err := o.KubeClient.Get(ctx, req.NamespacedName, serviceAccount)
 	if err != nil && errors.IsNotFound(err) {
 		del = true
+		exists = false
 	} else if err != nil {
 		return ctrl.Result{}, err
 	}
+	// The objects may be in the vault namespace of a rule that has since
+	// been changed or removed
+	o.addVaultNamespace(serviceAccount.Annotations[o.statusAnnotation(vaultNamespaceStatusAnnotation)])
 
 	// If the service account exists but isn't valid for reconciling that means
 	// it could have previously been valid but the annotation has since been
 	// removed or changed to a value that violates the rules described in
 	// the config file. In which case it should be removed from vault.
 	secretIdentity := serviceAccount.Annotations[o.provider.secretIdentityAnnotation()]
-	if !o.admitEvent(req.Namespace, secretIdentity) {
+	denied := ""
+	rule, admitted := o.admitRule(serviceAccount)
+	if !admitted {
+		if exists && secretIdentity != "" {
+			denied = o.deniedReason(serviceAccount)
+			promDenials.WithLabelValues(o.provider.name(), req.Namespace).Inc()
+			o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonDenied, "Admit", "%s", denied)
+		}
 		del = true
 	}
 
 	// Delete the vault objects
 	if del {
-		return ctrl.Result{}, o.removeFromVault(req.Namespace, req.Name)
+		removed, err := o.removeFromVault(req.Namespace, req.Name)
+		if err != nil {
+			if exists {
+				o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonVaultError, "RemoveFromVault", "Error removing %s from vault: %s", o.name(req.Namespace, req.Name), err)
+				o.updateStatusOnError(ctx, serviceAccount, err)
+			}
+			return ctrl.Result{}, err
+		}
+		o.setManaged(req.NamespacedName, false)
+		result = reconcileResultDeleted
+		if !exists {
+			return ctrl.Result{}, nil
+		}
+		if removed {
+			o.recordEvent(serviceAccount, corev1.EventTypeNormal, reasonRemoved, "RemoveFromVault", "Removed %s from vault", o.name(req.Namespace, req.Name))
+		}
+
+		// The status is kept for denied service accounts to explain why
+		// they aren't synced, otherwise the service account isn't
+		// managed anymore and the status is removed
+		if denied != "" {
+			result = reconcileResultDenied
+			return ctrl.Result{}, o.updateStatus(ctx, serviceAccount, syncStatusDenied, denied, "", false)
+		}
+		return ctrl.Result{}, o.updateStatus(ctx, serviceAccount, "", "", "", false)
+	}
+
+	// A service account annotated with auto is given the identity rendered
+	// from the template of the rule that admitted it
+	resolved := o.resolveIdentity(serviceAccount, rule)
+	secretIdentity = resolved.Annotations[o.provider.secretIdentityAnnotation()]
+
+	// The ttl is bounded by the rule that admitted the service account
+	secretTTL, err := o.provider.secretTTL(serviceAccount, rule)
+	if err != nil {
+		o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonInvalidTTL, "WriteToVault", "Invalid ttl annotation: %s", err)
+		o.updateStatusOnError(ctx, serviceAccount, err)
+		return ctrl.Result{}, err
 	}
 
-	payload, err := o.provider.secretPayload(serviceAccount)
+	payload, err := o.provider.secretPayload(resolved, secretTTL)
 	if err != nil {
+		o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonInvalidAnnotation, "WriteToVault", "Invalid annotations: %s", err)
+		o.updateStatusOnError(ctx, serviceAccount, err)
 		return ctrl.Result{}, err
 	}
 
-	secretTTL, err := o.provider.secretTTL(serviceAccount)
+	policy, err := o.provider.renderPolicyTemplate(o.name(req.Namespace, req.Name), resolved, rule)
 	if err != nil {
+		o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonInvalidAnnotation, "WriteToVault", "Invalid policy: %s", err)
+		o.updateStatusOnError(ctx, serviceAccount, err)
 		return ctrl.Result{}, err
 	}
 
-	err = o.writeToVault(req.Namespace, req.Name, payload, secretTTL)
+	// The objects are written to the vault namespace of the rule that
+	// admitted the service account, if it sets one
+	changed, err := o.writeToVault(resolved, rule.vaultNamespace, policy, payload, secretTTL)
+	if err != nil {
+		o.recordEvent(serviceAccount, corev1.EventTypeWarning, reasonVaultError, "WriteToVault", "Error writing %s to vault: %s", o.name(req.Namespace, req.Name), err)
+		o.updateStatusOnError(ctx, serviceAccount, err)
+		return ctrl.Result{}, err
+	}
+	if changed {
+		o.recordEvent(serviceAccount, corev1.EventTypeNormal, reasonWritten, "WriteToVault", "Wrote %s to vault for %s", o.name(req.Namespace, req.Name), secretIdentity)
+	}
+	o.setManaged(req.NamespacedName, true)
+	result = reconcileResultWritten
+
+	return ctrl.Result{}, o.updateStatus(ctx, serviceAccount, syncStatusSynced, "", rule.vaultNamespace, changed)
+}
+
+// setManaged records whether the service account is written to vault and
+// updates the managed serviceaccounts gauge
+func (o *Operator) setManaged(serviceAccount types.NamespacedName, managed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if managed {
+		o.managed[serviceAccount] = true
+	} else {
+		delete(o.managed, serviceAccount)
+	}
+	promManagedServiceAccounts.WithLabelValues(o.provider.name()).Set(float64(len(o.managed)))
+}
+
+// isManaged returns true if the service account has been written to vault
+func (o *Operator) isManaged(serviceAccount types.NamespacedName) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.managed[serviceAccount]
+}
+
+// loadAccessRules loads the access rule resources into the provider and
+// records that they have been loaded
+func (o *Operator) loadAccessRules(ctx context.Context) error {
+	if err := o.provider.loadAccessRules(ctx, o.KubeClient); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.accessRulesLoaded = true
+
+	return nil
+}
+
+// isAccessRulesLoaded returns true if the access rule resources have been
+// loaded
+func (o *Operator) isAccessRulesLoaded() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.accessRulesLoaded
+}
+
+// recordEvent emits an event on the given service account, if the operator
+// has been configured with an event recorder and isn't in dry-run mode
+func (o *Operator) recordEvent(serviceAccount *corev1.ServiceAccount, eventType, reason, action, note string, args ...interface{}) {
+	if o.Recorder == nil || o.DryRun {
+		return
+	}
+	o.Recorder.Eventf(serviceAccount, nil, eventType, reason, action, note, args...)
+}
+
+// deniedReason explains why the secret identity of a service account wasn't
+// admitted by the rules of the provider
+func (o *Operator) deniedReason(serviceAccount *corev1.ServiceAccount) string {
+	namespaceLabels, err := o.namespaceLabels(context.Background(), serviceAccount.Namespace)
+	return o.deniedReasonWithLabels(serviceAccount, namespaceLabels, err)
+}
+
+// deniedReasonWithLabels is deniedReason for a namespace with the given
+// labels, or the error getting them
+func (o *Operator) deniedReasonWithLabels(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string, err error) string {
+	ruleSet := o.provider.name() + ".rules"
+	secretIdentity := serviceAccount.Annotations[o.provider.secretIdentityAnnotation()]
+	if o.WatchAccessRules && !o.provider.hasRules() {
+		return fmt.Sprintf("%s %s is not allowed, there are no %s or access rules", o.provider.secretIdentityAnnotation(), secretIdentity, ruleSet)
+	}
+	if err == nil {
+		_, err = o.matchServiceAccount(serviceAccount, namespaceLabels)
+	}
+	if err != nil {
+		return fmt.Sprintf("%s %s was denied by %s: %s", o.provider.secretIdentityAnnotation(), secretIdentity, ruleSet, err)
+	}
+	return fmt.Sprintf("%s %s is not allowed in namespace %s by %s", o.provider.secretIdentityAnnotation(), secretIdentity, serviceAccount.Namespace, ruleSet)
+}
+
+// statusAnnotation returns the name of the given status annotation for this
+// provider. The provider is part of the name because a service account can be
+// managed by more than one provider.
+func (o *Operator) statusAnnotation(name string) string {
+	return "vault.uw.systems/" + o.provider.name() + "-" + name
+}
+
+// updateStatus patches the status annotations on the service account with
+// the outcome of the last reconcile. The service account is only patched if
+// the annotations have changed. The last synced time is only updated when the
+// objects in vault have been changed, or the service account has just become
+// synced, so that resyncs don't patch every service account. The vault
+// namespace that the objects were written to is recorded when they're synced,
+// and kept on errors since the objects are still there. An empty status
+// removes the annotations. In dry-run mode nothing is synced, so the
+// annotations are left alone.
+func (o *Operator) updateStatus(ctx context.Context, serviceAccount *corev1.ServiceAccount, status, syncError, vaultNamespace string, changed bool) error {
+	if o.DryRun {
+		return nil
+	}
+
+	vaultRoleAnnotation := o.statusAnnotation(vaultRoleStatusAnnotation)
+	lastSyncedAnnotation := o.statusAnnotation(lastSyncedStatusAnnotation)
+	syncStatusAnnotation := o.statusAnnotation(syncStatusStatusAnnotation)
+	syncErrorAnnotation := o.statusAnnotation(syncErrorStatusAnnotation)
+	vaultNamespaceAnnotation := o.statusAnnotation(vaultNamespaceStatusAnnotation)
+
+	desired := map[string]string{}
+	for k, v := range serviceAccount.Annotations {
+		desired[k] = v
+	}
+
+	switch status {
+	case "":
+		delete(desired, vaultRoleAnnotation)
+		delete(desired, lastSyncedAnnotation)
+		delete(desired, syncStatusAnnotation)
+		delete(desired, syncErrorAnnotation)
+		delete(desired, vaultNamespaceAnnotation)
+	case syncStatusSynced:
+		desired[vaultRoleAnnotation] = o.name(serviceAccount.Namespace, serviceAccount.Name)
+		if vaultNamespace != "" && vaultNamespace != o.VaultClient.Namespace() {
+			desired[vaultNamespaceAnnotation] = vaultNamespace
+		} else {
+			delete(desired, vaultNamespaceAnnotation)
+		}
+		if changed || desired[syncStatusAnnotation] != status || desired[lastSyncedAnnotation] == "" {
+			desired[lastSyncedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		}
+		desired[syncStatusAnnotation] = status
+		delete(desired, syncErrorAnnotation)
+	case syncStatusDenied:
+		// The vault objects have been removed
+		delete(desired, vaultRoleAnnotation)
+		delete(desired, vaultNamespaceAnnotation)
+		desired[syncStatusAnnotation] = status
+		desired[syncErrorAnnotation] = syncError
+	default:
+		desired[syncStatusAnnotation] = status
+		desired[syncErrorAnnotation] = syncError
+	}
 
-	return ctrl.Result{}, err
+	if reflect.DeepEqual(desired, serviceAccount.Annotations) || (len(desired) == 0 && len(serviceAccount.Annotations) == 0) {
+		return nil
+	}
+
+	patch := client.MergeFrom(serviceAccount.DeepCopy())
+	serviceAccount.Annotations = desired
+	if err := o.KubeClient.Patch(ctx, serviceAccount, patch); err != nil {
+		return fmt.Errorf("error updating status annotations: %w", err)
+	}
+
+	return nil
+}
+
+// updateStatusOnError records an error in the status annotations of the
+// service account. Failing to do so is logged rather than returned, so that
+// the original error is surfaced.
+func (o *Operator) updateStatusOnError(ctx context.Context, serviceAccount *corev1.ServiceAccount, syncError error) {
+	if err := o.updateStatus(ctx, serviceAccount, syncStatusError, syncError.Error(), "", false); err != nil {
+		o.log.Error(err, "error updating status annotations", "namespace", serviceAccount.Namespace, "serviceaccount", serviceAccount.Name)
+	}
 }
 
 // admitEvent controls whether an event should be reconciled or not based on the
 // presence of a role arn and whether the role arn or GCP service account is
-// permitted for this namespace by the rules laid out in the config file.
+// permitted for the service account by the rules laid out in the config file.
 // In AWS secretEntity is a role ARN and in GCP it is a service account email.
-func (o *Operator) admitEvent(namespace, secretIdentity string) bool {
-	if secretIdentity != "" {
-		allowed, err := o.provider.allow(namespace, secretIdentity)
-		if err != nil {
-			o.log.Error(err, "error matching role arn against rules for namespace", "secretIdentity", secretIdentity, "namespace", namespace)
-		} else if allowed {
-			return true
+// When access rule resources are watched, nothing is admitted until they've
+// been loaded, and an empty set of rules admits nothing rather than
+// everything, so that removing the last access rule doesn't allow any
+// identity.
+func (o *Operator) admitEvent(serviceAccount *corev1.ServiceAccount) bool {
+	_, admitted := o.admitRule(serviceAccount)
+	return admitted
+}
+
+// admitRule is admitEvent, which also returns the rule that admits the service
+// account
+func (o *Operator) admitRule(serviceAccount *corev1.ServiceAccount) (matchedRule, bool) {
+	if o.WatchAccessRules && (!o.isAccessRulesLoaded() || !o.provider.hasRules()) {
+		return matchedRule{index: -1}, false
+	}
+
+	secretIdentity := serviceAccount.Annotations[o.provider.secretIdentityAnnotation()]
+	if secretIdentity == "" {
+		return matchedRule{index: -1}, false
+	}
+
+	namespaceLabels, err := o.namespaceLabels(context.Background(), serviceAccount.Namespace)
+	if err != nil {
+		o.log.Error(err, "error getting namespace labels", "namespace", serviceAccount.Namespace)
+		return matchedRule{index: -1}, false
+	}
+	rule, err := o.matchServiceAccount(serviceAccount, namespaceLabels)
+	if err != nil {
+		o.log.Error(err, "error matching role arn against rules for namespace", "secretIdentity", secretIdentity, "namespace", serviceAccount.Namespace)
+		return matchedRule{index: -1}, false
+	}
+
+	return rule, rule.allowed
+}
+
+// matchServiceAccount returns the rule of the provider that admits the service
+// account. The extra policies of the service account can't be the policies of
+// other service accounts, whichever the rule allows.
+func (o *Operator) matchServiceAccount(serviceAccount *corev1.ServiceAccount, namespaceLabels map[string]string) (matchedRule, error) {
+	rule, err := o.provider.matchRule(serviceAccount, namespaceLabels)
+	if err != nil || !rule.allowed {
+		return rule, err
+	}
+
+	return rule, checkManagedPolicies(serviceAccount, o.Prefix)
+}
+
+// namespaceLabels returns the labels of the given namespace, for the namespace
+// selectors of the rules. A namespace that doesn't exist has no labels. Without
+// a kubernetes client, as when checking manifests, namespaces have no labels
+// either.
+func (o *Operator) namespaceLabels(ctx context.Context, name string) (map[string]string, error) {
+	if o.KubeClient == nil {
+		return nil, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := o.KubeClient.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
 		}
+		return nil, err
 	}
 
-	return false
+	return namespace.Labels, nil
+}
+
+// admitObject is admitEvent for the objects in controller-runtime events
+func (o *Operator) admitObject(obj client.Object) bool {
+	serviceAccount, ok := obj.(*corev1.ServiceAccount)
+	if !ok {
+		return false
+	}
+
+	return o.admitEvent(serviceAccount)
+}
+
+// annotatedObject returns true if the object is a service account with the
+// secret identity annotation of the provider, whether or not the rules admit
+// it. Reconciling a denied service account removes it from vault and records
+// why it was denied.
+func (o *Operator) annotatedObject(obj client.Object) bool {
+	if _, ok := obj.(*corev1.ServiceAccount); !ok {
+		return false
+	}
+
+	return obj.GetAnnotations()[o.provider.secretIdentityAnnotation()] != ""
 }
 
 // SetupWithManager adds the operator as a runnable and a reconciler on the controller-runtime manager. It also
@@ -177,29 +607,155 @@ func (o *Operator) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ServiceAccount{}).
-		WithEventFilter(predicate.Funcs{
-			CreateFunc: func(e event.CreateEvent) bool {
-				return o.admitEvent(e.Object.GetNamespace(), e.Object.GetAnnotations()[o.provider.secretIdentityAnnotation()])
-			},
-			DeleteFunc: func(e event.DeleteEvent) bool {
-				return o.admitEvent(e.Object.GetNamespace(), e.Object.GetAnnotations()[o.provider.secretIdentityAnnotation()])
-			},
-			GenericFunc: func(e event.GenericEvent) bool {
-				return o.admitEvent(e.Object.GetNamespace(), e.Object.GetAnnotations()[o.provider.secretIdentityAnnotation()])
-			},
-			UpdateFunc: func(e event.UpdateEvent) bool {
-				// Update events are a special case, because we
-				// want to remove the roles in vault when the
-				// annotation is removed or changed to an
-				// invalid value.
-				return o.provider.processUpdateEvent(e)
-			},
-		}).
+	// The informers of the watched types are registered on the cache,
+	// which runs on every replica, rather than left to the controller,
+	// which only starts once the replica is elected. Standby replicas then
+	// have a synced cache when they're ready and take over without a cold
+	// start.
+	watched := []client.Object{&corev1.ServiceAccount{}, &corev1.Namespace{}}
+	if o.WatchAccessRules {
+		watched = append(watched, o.provider.accessRule())
+	}
+	for _, obj := range watched {
+		if _, err := mgr.GetCache().GetInformer(context.Background(), obj); err != nil {
+			return fmt.Errorf("error getting informer for %T: %w", obj, err)
+		}
+	}
+
+	// Controller names must be unique within a manager, so the provider is
+	// included to allow an operator per provider on the same manager
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("serviceaccount-"+o.provider.name()).
+		For(&corev1.ServiceAccount{}, builder.WithPredicates(o.serviceAccountPredicates()))
+
+	if o.WatchAccessRules {
+		b = b.Watches(o.provider.accessRule(), handler.EnqueueRequestsFromMapFunc(o.accessRulesChanged))
+	}
+
+	// Rules can select namespaces by their labels, so the service accounts
+	// in a namespace are reconciled when its labels change
+	b = b.Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(o.namespaceChanged), builder.WithPredicates(predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+		},
+	}))
+
+	return b.WatchesRawSource(source.Channel(o.reconcileAll, handler.EnqueueRequestsFromMapFunc(o.annotatedServiceAccounts))).
 		Complete(o)
 }
 
+// serviceAccountPredicates filters the service account events that are
+// reconciled
+func (o *Operator) serviceAccountPredicates() predicate.Funcs {
+	return predicate.Funcs{
+		// Denied service accounts are reconciled when they're created,
+		// or found when the operator starts, so that they're told why
+		// they were denied
+		CreateFunc: func(e event.CreateEvent) bool {
+			return o.annotatedObject(e.Object)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return o.admitObject(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return o.annotatedObject(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// Update events are a special case, because we want to
+			// remove the roles in vault when the annotation is
+			// removed or changed to an invalid value. Providers only
+			// compare the annotations they read, so the status
+			// annotations patched by the operator don't trigger
+			// another reconcile. Rules can select service accounts
+			// by their labels, so a change to them is reconciled
+			// too, as is a change to the extra policies.
+			return o.provider.processUpdateEvent(e) ||
+				!reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) ||
+				e.ObjectOld.GetAnnotations()[extraPoliciesAnnotation] != e.ObjectNew.GetAnnotations()[extraPoliciesAnnotation]
+		},
+	}
+}
+
+// updateConfig replaces the rules and ttl settings of the provider with those
+// in the given config and reconciles every annotated service account, so that
+// the objects in vault are created, updated or removed to match
+func (o *Operator) updateConfig(fc *fileConfig) {
+	o.provider.updateConfig(fc)
+	resetExpressionErrors()
+	o.triggerReconcileAll()
+}
+
+// triggerReconcileAll triggers a reconcile of every annotated service account
+func (o *Operator) triggerReconcileAll() {
+	// The channel is only read once the controller has started, which is
+	// after this replica has been elected. Pending events are coalesced,
+	// since a single one reconciles everything.
+	select {
+	case o.reconcileAll <- event.GenericEvent{Object: &corev1.ServiceAccount{}}:
+	default:
+	}
+}
+
+// accessRulesChanged reloads the access rule resources of the provider when
+// one of them changes and returns a request for every service account that is
+// annotated for the provider, so that their objects in vault are created or
+// removed according to the new rules
+func (o *Operator) accessRulesChanged(ctx context.Context, _ client.Object) []reconcile.Request {
+	if err := o.loadAccessRules(ctx); err != nil {
+		o.log.Error(err, "error loading access rules")
+		return nil
+	}
+	resetExpressionErrors()
+
+	requests := o.annotatedServiceAccounts(ctx, nil)
+	o.log.Info("access rules changed", "serviceaccounts", len(requests))
+
+	return requests
+}
+
+// annotatedServiceAccounts returns a request for every service account that is
+// annotated for the provider, whether or not it's admitted by the rules
+func (o *Operator) annotatedServiceAccounts(ctx context.Context, _ client.Object) []reconcile.Request {
+	return o.listAnnotatedServiceAccounts(ctx)
+}
+
+// namespaceChanged returns a request for every service account in the
+// namespace that is annotated for the provider
+func (o *Operator) namespaceChanged(ctx context.Context, namespace client.Object) []reconcile.Request {
+	requests := o.listAnnotatedServiceAccounts(ctx, client.InNamespace(namespace.GetName()))
+	o.log.V(1).Info("namespace labels changed", "namespace", namespace.GetName(), "serviceaccounts", len(requests))
+
+	return requests
+}
+
+// listAnnotatedServiceAccounts returns a request for every service account
+// matching the list options that is annotated for the provider
+func (o *Operator) listAnnotatedServiceAccounts(ctx context.Context, opts ...client.ListOption) []reconcile.Request {
+	serviceAccountList := &corev1.ServiceAccountList{}
+	if err := o.KubeClient.List(ctx, serviceAccountList, opts...); err != nil {
+		o.log.Error(err, "error listing serviceaccounts")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, serviceAccount := range serviceAccountList.Items {
+		if serviceAccount.Annotations[o.provider.secretIdentityAnnotation()] == "" {
+			continue
+		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: serviceAccount.Namespace,
+				Name:      serviceAccount.Name,
+			},
+		})
+	}
+
+	return requests
+}
+
 // name returns a unique name for the key in vault, derived from the namespace
 // and name of the k8s serviceAccount.
 func (o *Operator) name(namespace, serviceAccount string) string {
@@ -217,127 +773,389 @@ func (o *Operator) parseKey(key string) (string, string, bool) {
 	return "", "", false
 }
 
+// vaultObject is an object in vault that the operator manages for a service
+// account
+type vaultObject struct {
+	kind string
+	// namespace is the vault namespace of the object, the default
+	// namespace of the vault client if it's empty
+	namespace string
+	path      string
+	data      map[string]interface{}
+}
+
+// vaultReadPath returns the path that an object written to the given path is
+// read from. Policies read from sys/policy are returned under 'rules' rather
+// than 'policy', so they're read from sys/policies/acl instead.
+func vaultReadPath(path string) string {
+	if strings.HasPrefix(path, "sys/policy/") {
+		return "sys/policies/acl/" + strings.TrimPrefix(path, "sys/policy/")
+	}
+
+	return path
+}
+
+// errVaultReadDenied is returned by readFromVault when the policy of the
+// operator doesn't allow it to read the object, in which case it isn't known
+// whether the object exists
+var errVaultReadDenied = fmt.Errorf("vault denied reading the object")
+
+// readFromVault returns the current data of the object in vault, or nil if it
+// doesn't exist. Objects are only read to avoid writes and deletes that
+// wouldn't change anything, so a denied read doesn't trigger a login, and is
+// logged once rather than failing the reconcile.
+func (o *Operator) readFromVault(obj vaultObject) (map[string]interface{}, error) {
+	existing, err := o.vaultClient(obj.namespace).Logical().ReadWithContext(withoutRelogin(context.Background()), vaultReadPath(obj.path))
+	if respErr, ok := err.(*vault.ResponseError); ok && respErr.StatusCode == http.StatusForbidden {
+		o.readDenied.Do(func() {
+			o.log.Error(err, "vault denied reading an object, objects are written and deleted without checking whether they're up to date", "path", vaultReadPath(obj.path), "vaultNamespace", obj.namespace)
+		})
+		return nil, errVaultReadDenied
+	}
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	return existing.Data, nil
+}
+
+// vaultClient returns the vault client for the given vault namespace
+func (o *Operator) vaultClient(vaultNamespace string) *vault.Client {
+	if vaultNamespace == "" || vaultNamespace == o.VaultClient.Namespace() {
+		return o.VaultClient
+	}
+
+	return o.VaultClient.WithNamespace(vaultNamespace)
+}
+
+// addVaultNamespace records a vault namespace that objects may have been
+// written to
+func (o *Operator) addVaultNamespace(vaultNamespace string) {
+	if vaultNamespace == "" {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.knownVaultNamespaces[vaultNamespace] = true
+}
+
+// vaultNamespaces returns the vault namespaces that the objects can be in,
+// starting with the default namespace of the vault client, which is empty. It
+// includes the namespaces of the current rules, and those of previous rules
+// or recorded in the status of service accounts since the operator started.
+func (o *Operator) vaultNamespaces() []string {
+	for _, vaultNamespace := range o.provider.vaultNamespaces() {
+		o.addVaultNamespace(vaultNamespace)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	vaultNamespaces := []string{""}
+	for vaultNamespace := range o.knownVaultNamespaces {
+		if vaultNamespace != o.VaultClient.Namespace() {
+			vaultNamespaces = append(vaultNamespaces, vaultNamespace)
+		}
+	}
+	slices.Sort(vaultNamespaces[1:])
+
+	return vaultNamespaces
+}
+
+// vaultObjects returns all of the objects that the service account can have
+// in vault, in the given vault namespaces and under every secret path
+func (o *Operator) vaultObjects(namespace, serviceAccount string, vaultNamespaces []string) []vaultObject {
+	n := o.name(namespace, serviceAccount)
+
+	var objects []vaultObject
+	for _, vaultNamespace := range vaultNamespaces {
+		for _, path := range o.provider.secretPaths() {
+			objects = append(objects, vaultObject{kind: "secret identity", namespace: vaultNamespace, path: path + n})
+		}
+		objects = append(objects,
+			vaultObject{kind: "kubernetes auth backend role", namespace: vaultNamespace, path: "auth/" + o.KubernetesAuthBackend + "/role/" + n},
+			vaultObject{kind: "policy", namespace: vaultNamespace, path: "sys/policy/" + n},
+		)
+	}
+
+	return objects
+}
+
 // writeToVault creates the kubernetes auth role and aws secret role gcp static
 // account required for the given k8s serviceAccount to login and use the
-// provided AWS role arn or GCP service account.
-func (o *Operator) writeToVault(namespace, serviceAccount string, data map[string]interface{}, secretTTL time.Duration) error {
-	n := o.name(namespace, serviceAccount)
+// provided AWS role arn or GCP service account. It returns whether any objects
+// in vault were written or deleted.
+func (o *Operator) writeToVault(serviceAccount *corev1.ServiceAccount, vaultNamespace, policy string, data map[string]interface{}, secretTTL time.Duration) (bool, error) {
+	namespace, name := serviceAccount.Namespace, serviceAccount.Name
+	secretIdentity := serviceAccount.Annotations[o.provider.secretIdentityAnnotation()]
+	n := o.name(namespace, name)
+	if vaultNamespace == o.VaultClient.Namespace() {
+		vaultNamespace = ""
+	}
 
-	// Create policy for kubernetes auth role
-	policy, err := o.provider.renderPolicyTemplate(n)
-	if err != nil {
-		return err
+	objects := []vaultObject{
+		// Create policy for kubernetes auth role
+		{
+			kind:      "policy",
+			namespace: vaultNamespace,
+			path:      "sys/policy/" + n,
+			data: map[string]interface{}{
+				"policy": policy,
+			},
+		},
+		// Create kubernetes auth backend role
+		{
+			kind:      "kubernetes auth backend role",
+			namespace: vaultNamespace,
+			path:      "auth/" + o.KubernetesAuthBackend + "/role/" + n,
+			data: map[string]interface{}{
+				"bound_service_account_names":      []string{name},
+				"bound_service_account_namespaces": []string{namespace},
+				"policies":                         rolePolicies(n, serviceAccount),
+
+				// Set token lease duration same as the actual secret ttl
+				// GCP service Account key is associated with a Vault lease.
+				// When the lease expires, the service account key is automatically revoked.
+				// AWS IAM credentials are time-based and are automatically revoked when the Vault lease expires.
+				// https://github.com/hashicorp/vault-plugin-secrets-gcp/issues/141#issuecomment-1315703226
+				// https://github.com/hashicorp/vault/issues/10443
+				// token lease ttl doesn't have affect on AWS STS credentials as they cannot be revoked/renewed.
+				"ttl": secretTTL.Seconds(),
+			},
+		},
+		// Create AWS secret backend role or GCP static account
+		{
+			kind:      "secret identity",
+			namespace: vaultNamespace,
+			path:      o.provider.secretPath(secretIdentity) + n,
+			data:      data,
+		},
 	}
-	if _, err := o.VaultClient.Logical().Write("sys/policy/"+n, map[string]interface{}{
-		"policy": policy,
-	}); err != nil {
-		return err
+
+	// The objects are removed from the other paths and from the vault
+	// namespace in the status, in case they were written to another one
+	// before. This is only the case for service accounts admitted by a
+	// rule with another vault namespace, or for AWS roles that have moved
+	// to another partition. Other vault namespaces are left to garbage
+	// collection, so that a reconcile doesn't read from all of them.
+	previous := serviceAccount.Annotations[o.statusAnnotation(vaultNamespaceStatusAnnotation)]
+	if previous == o.VaultClient.Namespace() {
+		previous = ""
 	}
-	o.log.Info("Wrote policy", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
-
-	// Create kubernetes auth backend role
-	if _, err := o.VaultClient.Logical().Write("auth/"+o.KubernetesAuthBackend+"/role/"+n, map[string]interface{}{
-		"bound_service_account_names":      []string{serviceAccount},
-		"bound_service_account_namespaces": []string{namespace},
-		"policies":                         []string{"default", n},
-
-		// Set token lease duration same as the actual secret ttl
-		// GCP service Account key is associated with a Vault lease.
-		// When the lease expires, the service account key is automatically revoked.
-		// AWS IAM credentials are time-based and are automatically revoked when the Vault lease expires.
-		// https://github.com/hashicorp/vault-plugin-secrets-gcp/issues/141#issuecomment-1315703226
-		// https://github.com/hashicorp/vault/issues/10443
-		// token lease ttl doesn't have affect on AWS STS credentials as they cannot be revoked/renewed.
-		"ttl": secretTTL.Seconds(),
-	}); err != nil {
-		return err
+	// Objects that can't be read are deleted too, but aren't reported as
+	// a change since they may not exist
+	var stale, unknown []vaultObject
+	for _, obj := range o.vaultObjects(namespace, name, slices.Compact([]string{vaultNamespace, previous})) {
+		if slices.ContainsFunc(objects, func(w vaultObject) bool {
+			return w.namespace == obj.namespace && w.path == obj.path
+		}) {
+			continue
+		}
+		current, err := o.readFromVault(obj)
+		if err == errVaultReadDenied {
+			unknown = append(unknown, obj)
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if current != nil {
+			stale = append(stale, obj)
+		}
+	}
+	if err := o.deleteFromVault(namespace, name, append(stale, unknown...)); err != nil {
+		return false, err
 	}
-	o.log.Info("Wrote kubernetes auth backend role", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
-	// Create AWS secret backend role or GCP static account
-	if _, err := o.VaultClient.Logical().Write(o.provider.secretPath()+n, data); err != nil {
-		return err
+	if o.DryRun {
+		for _, obj := range objects {
+			if err := o.planWrite(obj); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
 	}
-	o.log.Info("Wrote secret identity to vault", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
-	return nil
+	// Objects that are already up to date aren't written again, so that
+	// resyncs don't write every object to vault
+	var applied, skipped int
+	for _, obj := range objects {
+		current, err := o.readFromVault(obj)
+		if err != nil && err != errVaultReadDenied {
+			return false, err
+		}
+		data := obj.data
+		if current != nil {
+			diff := diffVaultData(current, obj.data)
+			if len(diff) == 0 {
+				skipped++
+				promVaultWrites.WithLabelValues(o.provider.name(), vaultWriteResultSkipped).Inc()
+				o.log.V(1).Info("Unchanged "+obj.kind, "namespace", namespace, "serviceaccount", name, "key", n, "vaultNamespace", obj.namespace)
+				continue
+			}
+			data = vaultWriteData(obj.data, diff)
+		}
+		if _, err := o.vaultClient(obj.namespace).Logical().Write(obj.path, data); err != nil {
+			return false, err
+		}
+		applied++
+		promVaultWrites.WithLabelValues(o.provider.name(), vaultWriteResultApplied).Inc()
+		o.log.Info("Wrote "+obj.kind, "namespace", namespace, "serviceaccount", name, "key", n, "vaultNamespace", obj.namespace)
+	}
+
+	logger := o.log.V(1)
+	if applied > 0 {
+		logger = o.log
+	}
+	logger.Info("Reconciled vault objects", "namespace", namespace, "serviceaccount", name, "key", n, "applied", applied, "skipped", skipped)
+
+	return applied > 0 || len(stale) > 0, nil
 }
 
-// removeFromVault removes the items from vault for the provided serviceaccount
-func (o *Operator) removeFromVault(namespace, serviceAccount string) error {
+// removeFromVault removes the items from vault for the provided
+// serviceaccount. Only the objects that exist are deleted, and it returns
+// whether there were any.
+func (o *Operator) removeFromVault(namespace, serviceAccount string) (bool, error) {
+	var existing []vaultObject
+	for _, obj := range o.vaultObjects(namespace, serviceAccount, o.vaultNamespaces()) {
+		current, err := o.readFromVault(obj)
+		if err != nil && err != errVaultReadDenied {
+			return false, err
+		}
+		if current != nil || err == errVaultReadDenied {
+			existing = append(existing, obj)
+		}
+	}
+
+	return len(existing) > 0, o.deleteFromVault(namespace, serviceAccount, existing)
+}
+
+// deleteFromVault deletes the existing objects that belong to the service
+// account, or plans their deletion in dry-run mode
+func (o *Operator) deleteFromVault(namespace, serviceAccount string, objects []vaultObject) error {
 	n := o.name(namespace, serviceAccount)
 
-	_, err := o.VaultClient.Logical().Delete(o.provider.secretPath() + n)
-	if err != nil {
-		return err
+	for _, obj := range objects {
+		if o.DryRun {
+			if err := o.planDelete(obj); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := o.vaultClient(obj.namespace).Logical().Delete(obj.path); err != nil {
+			return err
+		}
+		o.log.Info("Deleted "+obj.kind, "namespace", namespace, "serviceaccount", serviceAccount, "key", n, "vaultNamespace", obj.namespace)
 	}
-	o.log.Info("Deleted secret identity from vault", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
-	_, err = o.VaultClient.Logical().Delete("auth/" + o.KubernetesAuthBackend + "/role/" + n)
+	return nil
+}
+
+// garbageCollect finds the keys of the objects managed by the operator in
+// vault and removes those that don't have a corresponding admitted
+// serviceaccount in Kubernetes. The serviceaccounts are listed once, and the
+// objects for a key are removed from every list at once. Errors are aggregated,
+// so that a key that can't be removed doesn't stop the others from being
+// collected.
+func (o *Operator) garbageCollect(ctx context.Context) error {
+	admitted, err := o.admittedServiceAccounts(ctx)
 	if err != nil {
 		return err
 	}
-	o.log.Info("Deleted Kubernetes auth role", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
-	_, err = o.VaultClient.Logical().Delete("sys/policy/" + n)
-	if err != nil {
-		return err
+	keys, errs := o.listKeys()
+	for _, key := range keys {
+		namespace, name, parsed := o.parseKey(key)
+		if !parsed {
+			continue
+		}
+		// Service accounts that were written since they were listed
+		// are kept as well
+		serviceAccount := types.NamespacedName{Namespace: namespace, Name: name}
+		if admitted[serviceAccount] || o.isManaged(serviceAccount) {
+			continue
+		}
+		if _, err := o.removeFromVault(namespace, name); err != nil {
+			errs = append(errs, fmt.Errorf("error removing %s: %w", key, err))
+			continue
+		}
+		if !o.DryRun {
+			promGarbageCollected.WithLabelValues(o.provider.name()).Inc()
+		}
 	}
-	o.log.Info("Deleted policy", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
-	return nil
+	return utilerrors.NewAggregate(errs)
 }
 
-// garbageCollect iterates through a list of keys from a vault list, finds items
-// managed by the operator and removes them if they don't have a corresponding
-// serviceaccount in Kubernetes
-func (o *Operator) garbageCollect(keys []interface{}) error {
-	for _, k := range keys {
-		key, ok := k.(string)
-		if !ok {
-			continue
+// admittedServiceAccounts returns the serviceaccounts in the cluster that are
+// annotated with a correct and valid annotation. The vault namespaces in their
+// status are recorded, so that they're garbage collected too.
+func (o *Operator) admittedServiceAccounts(ctx context.Context) (map[types.NamespacedName]bool, error) {
+	serviceAccountList := &corev1.ServiceAccountList{}
+	if err := o.KubeClient.List(ctx, serviceAccountList); err != nil {
+		return nil, err
+	}
+
+	admitted := map[types.NamespacedName]bool{}
+	for i := range serviceAccountList.Items {
+		serviceAccount := &serviceAccountList.Items[i]
+		o.addVaultNamespace(serviceAccount.Annotations[o.statusAnnotation(vaultNamespaceStatusAnnotation)])
+		if o.admitEvent(serviceAccount) {
+			admitted[types.NamespacedName{Namespace: serviceAccount.Namespace, Name: serviceAccount.Name}] = true
 		}
+	}
 
-		namespace, name, parsed := o.parseKey(key)
-		if parsed {
-			has, err := o.hasServiceAccount(namespace, name)
+	return admitted, nil
+}
+
+// listKeys returns the distinct keys in the lists of secret identities,
+// kubernetes auth roles and policies in every vault namespace, along with the
+// errors from the lists that failed
+func (o *Operator) listKeys() ([]string, []error) {
+	var (
+		keys []string
+		errs []error
+		seen = map[string]bool{}
+	)
+	for _, vaultNamespace := range o.vaultNamespaces() {
+		vaultClient := o.vaultClient(vaultNamespace)
+
+		// AWS secret roles or GCP static accounts, kubernetes auth roles
+		// and policies
+		var paths []string
+		paths = append(paths, o.provider.secretPaths()...)
+		paths = append(paths, "auth/"+o.KubernetesAuthBackend+"/role/", "sys/policy")
+		for _, path := range paths {
+			list, err := vaultClient.Logical().List(path)
 			if err != nil {
-				return err
+				errs = append(errs, fmt.Errorf("error listing %s: %w", path, err))
+				continue
 			}
-			if !has {
-				// Delete
-				err := o.removeFromVault(namespace, name)
-				if err != nil {
-					return err
+			if list == nil {
+				continue
+			}
+			listKeys, _ := list.Data["keys"].([]interface{})
+			for _, k := range listKeys {
+				if key, ok := k.(string); ok && !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
 				}
 			}
 		}
 	}
 
-	return nil
+	return keys, errs
 }
 
-// hasServiceAccount checks if a managed service account exists for the given
-// namespace+name combination, annotated with a correct and valid annotation
-func (o *Operator) hasServiceAccount(namespace, name string) (bool, error) {
-	serviceAccountList := &corev1.ServiceAccountList{}
-	err := o.KubeClient.List(context.Background(), serviceAccountList)
-	if err != nil {
-		return false, err
+// matchesServiceAccountName returns true if the rule allows the given service
+// account name, or if it doesn't have any service account name patterns
+func matchesServiceAccountName(name string, serviceAccountNamePatterns []string) (bool, error) {
+	if len(serviceAccountNamePatterns) == 0 {
+		return true, nil
 	}
 
-	for _, serviceAccount := range serviceAccountList.Items {
-		if serviceAccount.Namespace == namespace &&
-			serviceAccount.Name == name &&
-			o.admitEvent(
-				serviceAccount.Namespace,
-				serviceAccount.Annotations[o.provider.secretIdentityAnnotation()],
-			) {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return matchesNamespace(name, serviceAccountNamePatterns)
 }
 
 // matchesNamespace returns true if the rule allows the given namespace
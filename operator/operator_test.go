@@ -1,9 +1,25 @@
 package operator
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	vault "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
 func Test_matchesNamespace(t *testing.T) {
@@ -204,4 +220,807 @@ func Test_parseKey(t *testing.T) {
 			assert.Equal(t, tt.expectedName, sa)
 		})
 	}
+
+	azure, _ := NewAzureProvider(fc.Azure)
+	azo, _ := NewOperator(config, azure)
+
+	ns, sa, result := azo.parseKey("foo_azure_bar_my-service-account")
+	assert.True(t, result)
+	assert.Equal(t, "bar", ns)
+	assert.Equal(t, "my-service-account", sa)
+
+	_, _, result = azo.parseKey("foo_aws_bar_my-service-account")
+	assert.False(t, result)
+}
+
+// TestOperatorReconcileEvents tests that the outcome of a reconcile is
+// recorded as an event and in the status annotations on the service account
+func TestOperatorReconcileEvents(t *testing.T) {
+	var requests []string
+	existing := map[string]bool{"/v1/aws/roles/vkcc_aws_foo_denied": true}
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodGet && existing[r.URL.Path]:
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+		case r.Method == http.MethodDelete:
+			delete(existing, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().
+		WithObjects(
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "allowed",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+					},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "denied",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+					},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "invalid-ttl",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation:       "arn:aws:iam::111111111111:role/foo-role",
+						defaultSTSTTLAnnotation: "1m",
+					},
+				},
+			},
+		).
+		Build()
+
+	recorder := events.NewFakeRecorder(10)
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		Recorder:              recorder,
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	reconciles := func(result string) float64 {
+		return testutil.ToFloat64(promReconciles.WithLabelValues("aws", result))
+	}
+	written, deleted, denied, errored := reconciles(reconcileResultWritten), reconciles(reconcileResultDeleted), reconciles(reconcileResultDenied), reconciles(reconcileResultError)
+	denials := testutil.ToFloat64(promDenials.WithLabelValues("aws", "foo"))
+
+	reconcile := func(name string) error {
+		_, err := o.Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      name,
+				Namespace: "foo",
+			},
+		})
+		return err
+	}
+
+	assert.NoError(t, reconcile("allowed"))
+	assert.Equal(t, []string{
+		"GET /v1/sys/policies/acl/vkcc_aws_foo_allowed",
+		"PUT /v1/sys/policy/vkcc_aws_foo_allowed",
+		"GET /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"PUT /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"GET /v1/aws/roles/vkcc_aws_foo_allowed",
+		"PUT /v1/aws/roles/vkcc_aws_foo_allowed",
+	}, requests)
+	assert.Equal(t, "Normal VaultWritten Wrote vkcc_aws_foo_allowed to vault for arn:aws:iam::111111111111:role/foo-role", <-recorder.Events)
+
+	assert.NoError(t, reconcile("denied"))
+	assert.Equal(t, "Warning Denied vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar-role is not allowed in namespace foo by aws.rules", <-recorder.Events)
+	assert.Equal(t, "Normal VaultRemoved Removed vkcc_aws_foo_denied from vault", <-recorder.Events)
+	assert.Empty(t, existing)
+
+	// Test that nothing is reported as removed when there was nothing in
+	// vault
+	assert.NoError(t, reconcile("denied"))
+	assert.Equal(t, "Warning Denied vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar-role is not allowed in namespace foo by aws.rules", <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+
+	assert.Error(t, reconcile("invalid-ttl"))
+	assert.Equal(t, "Warning InvalidTTL Invalid ttl annotation: minimum default-sts-ttl value allowed is 15m0s, its set to 1m0s", <-recorder.Events)
+
+	// Test that the status annotations have been written
+	sa := &corev1.ServiceAccount{}
+	assert.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Name: "allowed", Namespace: "foo"}, sa))
+	assert.Equal(t, "vkcc_aws_foo_allowed", sa.Annotations["vault.uw.systems/aws-vault-role"])
+	assert.Equal(t, "Synced", sa.Annotations["vault.uw.systems/aws-sync-status"])
+	assert.NotEmpty(t, sa.Annotations["vault.uw.systems/aws-last-synced"])
+	assert.NotContains(t, sa.Annotations, "vault.uw.systems/aws-sync-error")
+
+	assert.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Name: "denied", Namespace: "foo"}, sa))
+	assert.NotContains(t, sa.Annotations, "vault.uw.systems/aws-vault-role")
+	assert.Equal(t, "Denied", sa.Annotations["vault.uw.systems/aws-sync-status"])
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar-role is not allowed in namespace foo by aws.rules", sa.Annotations["vault.uw.systems/aws-sync-error"])
+
+	assert.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Name: "invalid-ttl", Namespace: "foo"}, sa))
+	assert.Equal(t, "Error", sa.Annotations["vault.uw.systems/aws-sync-status"])
+	assert.Equal(t, "minimum default-sts-ttl value allowed is 15m0s, its set to 1m0s", sa.Annotations["vault.uw.systems/aws-sync-error"])
+
+	// Test that the status annotations don't trigger another reconcile
+	oldSA := sa.DeepCopy()
+	delete(oldSA.Annotations, "vault.uw.systems/aws-sync-status")
+	delete(oldSA.Annotations, "vault.uw.systems/aws-sync-error")
+	assert.False(t, aws.processUpdateEvent(event.UpdateEvent{ObjectOld: oldSA, ObjectNew: sa}))
+
+	// Deleted service accounts can't have events recorded against them
+	assert.NoError(t, reconcile("deleted"))
+	assert.Empty(t, recorder.Events)
+
+	// Test that the outcomes have been counted
+	assert.Equal(t, written+1, reconciles(reconcileResultWritten))
+	assert.Equal(t, deleted+1, reconciles(reconcileResultDeleted))
+	assert.Equal(t, denied+2, reconciles(reconcileResultDenied))
+	assert.Equal(t, errored+1, reconciles(reconcileResultError))
+	assert.Equal(t, denials+2, testutil.ToFloat64(promDenials.WithLabelValues("aws", "foo")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(promManagedServiceAccounts.WithLabelValues("aws")))
+}
+
+// TestOperatorServiceAccountPredicates tests that denied service accounts pass
+// the create and generic predicates, so that they're reconciled and told why
+// they were denied, but service accounts without the annotation don't
+func TestOperatorServiceAccountPredicates(t *testing.T) {
+	denied := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/bar-role")
+	denied.Name = "denied"
+	unannotated := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "unannotated", Namespace: "foo"}}
+
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().WithObjects(denied, unannotated).Build()
+	recorder := events.NewFakeRecorder(10)
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		Recorder:              recorder,
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	predicates := o.serviceAccountPredicates()
+	assert.False(t, predicates.Create(event.CreateEvent{Object: unannotated}))
+	assert.False(t, predicates.Generic(event.GenericEvent{Object: unannotated}))
+	assert.True(t, predicates.Generic(event.GenericEvent{Object: denied}))
+	// There's nothing in vault for a denied service account that's deleted
+	assert.False(t, predicates.Delete(event.DeleteEvent{Object: denied}))
+
+	if !predicates.Create(event.CreateEvent{Object: denied}) {
+		t.Fatal("denied service account was filtered out on create")
+	}
+	_, err = o.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "denied", Namespace: "foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Warning Denied vault.uw.systems/aws-role arn:aws:iam::111111111111:role/bar-role is not allowed in namespace foo by aws.rules", <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+
+	sa := &corev1.ServiceAccount{}
+	assert.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Name: "denied", Namespace: "foo"}, sa))
+	assert.Equal(t, "Denied", sa.Annotations["vault.uw.systems/aws-sync-status"])
+}
+
+// TestOperatorReconcileUnchanged tests that objects which are already up to
+// date in vault aren't written again
+func TestOperatorReconcileUnchanged(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "allowed",
+			Namespace: "foo",
+			Annotations: map[string]string{
+				awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+			},
+		},
+	}
+	policy, err := aws.renderPolicyTemplate("vkcc_aws_foo_allowed", sa, matchRule(t, aws, sa))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := map[string]map[string]interface{}{
+		"/v1/sys/policies/acl/vkcc_aws_foo_allowed": {
+			"name":   "vkcc_aws_foo_allowed",
+			"policy": policy,
+		},
+		"/v1/auth/kubernetes/role/vkcc_aws_foo_allowed": {
+			"bound_service_account_names":      []string{"allowed"},
+			"bound_service_account_namespaces": []string{"foo"},
+			"policies":                         []string{"default", "vkcc_aws_foo_allowed"},
+			"token_policies":                   []string{"default", "vkcc_aws_foo_allowed"},
+			"token_ttl":                        900,
+			"ttl":                              900,
+			"token_bound_cidrs":                []string{},
+			"token_type":                       "default",
+			"alias_name_source":                "serviceaccount_uid",
+		},
+		"/v1/aws/roles/vkcc_aws_foo_allowed": {
+			"credential_type": "assumed_role",
+			"default_sts_ttl": 900,
+			"max_sts_ttl":     43200,
+			"role_arns":       []string{"arn:aws:iam::111111111111:role/old-role"},
+			"policy_arns":     nil,
+		},
+	}
+
+	var writes []string
+	bodies := map[string]map[string]interface{}{}
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writes = append(writes, r.Method+" "+r.URL.Path)
+			body := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			bodies[r.URL.Path] = body
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		data, ok := existing[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, _ := NewOperator(&Config{
+		KubeClient:            fake.NewClientBuilder().WithObjects(sa).Build(),
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	writesTotal := func(result string) float64 {
+		return testutil.ToFloat64(promVaultWrites.WithLabelValues("aws", result))
+	}
+	applied, skipped := writesTotal(vaultWriteResultApplied), writesTotal(vaultWriteResultSkipped)
+
+	_, err = o.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "allowed",
+			Namespace: "foo",
+		},
+	})
+	assert.NoError(t, err)
+
+	// Only the role, which has another arn, is written
+	assert.Equal(t, []string{"PUT /v1/aws/roles/vkcc_aws_foo_allowed"}, writes)
+	assert.Equal(t, applied+1, writesTotal(vaultWriteResultApplied))
+	assert.Equal(t, skipped+2, writesTotal(vaultWriteResultSkipped))
+
+	synced := &corev1.ServiceAccount{}
+	assert.NoError(t, o.KubeClient.Get(context.Background(), types.NamespacedName{Name: "allowed", Namespace: "foo"}, synced))
+	assert.NotEmpty(t, synced.Annotations["vault.uw.systems/aws-last-synced"])
+	synced.Annotations["vault.uw.systems/aws-last-synced"] = "2024-01-01T00:00:00Z"
+	assert.NoError(t, o.KubeClient.Update(context.Background(), synced))
+
+	// Test that the service account isn't patched when nothing has changed
+	existing["/v1/aws/roles/vkcc_aws_foo_allowed"]["role_arns"] = []string{"arn:aws:iam::111111111111:role/foo-role"}
+	writes = nil
+	_, err = o.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "allowed",
+			Namespace: "foo",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, writes)
+
+	resynced := &corev1.ServiceAccount{}
+	assert.NoError(t, o.KubeClient.Get(context.Background(), types.NamespacedName{Name: "allowed", Namespace: "foo"}, resynced))
+	assert.Equal(t, synced.ResourceVersion, resynced.ResourceVersion)
+	assert.Equal(t, synced.Annotations, resynced.Annotations)
+
+	// Test that fields that were set outside of the operator are written
+	// back to their defaults
+	existing["/v1/auth/kubernetes/role/vkcc_aws_foo_allowed"]["token_bound_cidrs"] = []string{"10.0.0.0/8"}
+	existing["/v1/auth/kubernetes/role/vkcc_aws_foo_allowed"]["token_type"] = "batch"
+	existing["/v1/aws/roles/vkcc_aws_foo_allowed"]["policy_arns"] = []string{"arn:aws:iam::aws:policy/AdministratorAccess"}
+	writes = nil
+	_, err = o.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "allowed",
+			Namespace: "foo",
+		},
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"PUT /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"PUT /v1/aws/roles/vkcc_aws_foo_allowed",
+	}, writes)
+	assert.Equal(t, []interface{}{}, bodies["/v1/auth/kubernetes/role/vkcc_aws_foo_allowed"]["token_bound_cidrs"])
+	assert.Equal(t, "default", bodies["/v1/auth/kubernetes/role/vkcc_aws_foo_allowed"]["token_type"])
+	assert.Equal(t, []interface{}{"default", "vkcc_aws_foo_allowed"}, bodies["/v1/auth/kubernetes/role/vkcc_aws_foo_allowed"]["policies"])
+	assert.Equal(t, []interface{}{}, bodies["/v1/aws/roles/vkcc_aws_foo_allowed"]["policy_arns"])
+	assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/foo-role"}, bodies["/v1/aws/roles/vkcc_aws_foo_allowed"]["role_arns"])
+}
+
+// TestOperatorReconcileReadDenied tests that the objects are written when the
+// policy of the operator doesn't allow it to read them
+func TestOperatorReconcileReadDenied(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "allowed",
+			Namespace: "foo",
+			Annotations: map[string]string{
+				awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+			},
+		},
+	}
+
+	var writes []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writes = append(writes, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, _ := NewOperator(&Config{
+		KubeClient:            fake.NewClientBuilder().WithObjects(sa).Build(),
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	_, err = o.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "allowed",
+			Namespace: "foo",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, writes, "PUT /v1/sys/policy/vkcc_aws_foo_allowed")
+	assert.Contains(t, writes, "PUT /v1/auth/kubernetes/role/vkcc_aws_foo_allowed")
+	assert.Contains(t, writes, "PUT /v1/aws/roles/vkcc_aws_foo_allowed")
+
+	synced := &corev1.ServiceAccount{}
+	assert.NoError(t, o.KubeClient.Get(context.Background(), types.NamespacedName{Name: "allowed", Namespace: "foo"}, synced))
+	assert.Equal(t, "Synced", synced.Annotations["vault.uw.systems/aws-sync-status"])
+}
+
+// TestOperatorReconcileVaultNamespace tests that the objects are written to the
+// vault namespace of the rule that admits the service account, and removed from
+// the other namespaces
+func TestOperatorReconcileVaultNamespace(t *testing.T) {
+	var requests []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.Header.Get("X-Vault-Namespace")+" "+r.URL.Path)
+		// The policy was written to the default namespace before
+		if r.Method == http.MethodGet && r.Header.Get("X-Vault-Namespace") == "" && r.URL.Path == "/v1/sys/policies/acl/vkcc_aws_foo_allowed" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"name": "vkcc_aws_foo_allowed"}})
+			return
+		}
+		// The service account that's deleted has a secret role
+		if r.Method == http.MethodGet && r.Header.Get("X-Vault-Namespace") == "tenant-a" && r.URL.Path == "/v1/aws/roles/vkcc_aws_foo_deleted" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().
+		WithObjects(&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "allowed",
+				Namespace: "foo",
+				Annotations: map[string]string{
+					awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+				},
+			},
+		}).
+		Build()
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+			VaultNamespace:    "tenant-a",
+		},
+	}
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	reconcile := func(name string) error {
+		_, err := o.Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{
+				Name:      name,
+				Namespace: "foo",
+			},
+		})
+		return err
+	}
+
+	assert.NoError(t, reconcile("allowed"))
+	assert.Equal(t, []string{
+		"GET  /v1/aws/roles/vkcc_aws_foo_allowed",
+		"GET  /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"GET  /v1/sys/policies/acl/vkcc_aws_foo_allowed",
+		"DELETE  /v1/sys/policy/vkcc_aws_foo_allowed",
+		"GET tenant-a /v1/sys/policies/acl/vkcc_aws_foo_allowed",
+		"PUT tenant-a /v1/sys/policy/vkcc_aws_foo_allowed",
+		"GET tenant-a /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"PUT tenant-a /v1/auth/kubernetes/role/vkcc_aws_foo_allowed",
+		"GET tenant-a /v1/aws/roles/vkcc_aws_foo_allowed",
+		"PUT tenant-a /v1/aws/roles/vkcc_aws_foo_allowed",
+	}, requests)
+
+	// The vault namespace is recorded in the status
+	serviceAccount := &corev1.ServiceAccount{}
+	require.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Namespace: "foo", Name: "allowed"}, serviceAccount))
+	assert.Equal(t, "tenant-a", serviceAccount.Annotations["vault.uw.systems/aws-vault-namespace"])
+
+	// The objects are looked for in every namespace when the service
+	// account is removed, and those that exist are deleted
+	requests = nil
+	assert.NoError(t, reconcile("deleted"))
+	assert.Equal(t, []string{
+		"GET  /v1/aws/roles/vkcc_aws_foo_deleted",
+		"GET  /v1/auth/kubernetes/role/vkcc_aws_foo_deleted",
+		"GET  /v1/sys/policies/acl/vkcc_aws_foo_deleted",
+		"GET tenant-a /v1/aws/roles/vkcc_aws_foo_deleted",
+		"GET tenant-a /v1/auth/kubernetes/role/vkcc_aws_foo_deleted",
+		"GET tenant-a /v1/sys/policies/acl/vkcc_aws_foo_deleted",
+		"DELETE tenant-a /v1/aws/roles/vkcc_aws_foo_deleted",
+	}, requests)
+
+	// A service account that stays in the same vault namespace is only
+	// looked for in that namespace, not in those of the other rules
+	aws.Rules = append(aws.Rules, AWSRule{
+		NamespacePatterns: []string{"bar"},
+		RoleNamePatterns:  []string{"bar-*"},
+		VaultNamespace:    "tenant-b",
+	})
+	requests = nil
+	assert.NoError(t, reconcile("allowed"))
+	assert.NotEmpty(t, requests)
+	for _, request := range requests {
+		assert.Contains(t, request, " tenant-a ")
+	}
+
+	// A rule in the default namespace of the client doesn't add another
+	// namespace next to those of the other rules
+	vaultClient.SetNamespace("tenant-a")
+	assert.Equal(t, []string{"", "tenant-b"}, o.vaultNamespaces())
+}
+
+// TestOperatorVaultNamespaceRemoved tests that the objects in the vault
+// namespace of a rule are removed after the rule has stopped setting it, and
+// after a restart, from the vault namespace recorded in the status
+func TestOperatorVaultNamespaceRemoved(t *testing.T) {
+	// The objects in vault, by vault namespace and path
+	existing := map[string]bool{
+		"tenant-a /v1/aws/roles/vkcc_aws_foo_allowed":            true,
+		"tenant-a /v1/auth/kubernetes/role/vkcc_aws_foo_allowed": true,
+		"tenant-a /v1/sys/policies/acl/vkcc_aws_foo_allowed":     true,
+		"tenant-a /v1/aws/roles/vkcc_aws_foo_orphan":             true,
+	}
+	var requests []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vaultNamespace := r.Header.Get("X-Vault-Namespace")
+		path := strings.Replace(r.URL.Path, "/v1/sys/policy/", "/v1/sys/policies/acl/", 1)
+		if r.URL.Query().Get("list") == "true" {
+			requests = append(requests, "LIST "+vaultNamespace+" "+r.URL.Path)
+			prefix := vaultNamespace + " " + strings.Replace(r.URL.Path, "/v1/sys/policy", "/v1/sys/policies/acl", 1) + "/"
+			var keys []string
+			for k := range existing {
+				if strings.HasPrefix(k, prefix) {
+					keys = append(keys, strings.TrimPrefix(k, prefix))
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+			return
+		}
+		requests = append(requests, r.Method+" "+vaultNamespace+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			if !existing[vaultNamespace+" "+path] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+			return
+		case http.MethodPut:
+			existing[vaultNamespace+" "+path] = true
+		case http.MethodDelete:
+			delete(existing, vaultNamespace+" "+path)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service account was synced to the vault namespace of the rule
+	kubeClient := fake.NewClientBuilder().
+		WithObjects(&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "allowed",
+				Namespace: "foo",
+				Annotations: map[string]string{
+					awsRoleAnnotation:                      "arn:aws:iam::111111111111:role/foo-role",
+					"vault.uw.systems/aws-vault-namespace": "tenant-a",
+				},
+			},
+		}).
+		Build()
+
+	// The operator restarts with a rule that doesn't set the vault
+	// namespace anymore
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"foo"},
+			RoleNamePatterns:  []string{"foo-*"},
+		},
+	}
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	// Garbage collection lists the vault namespace in the status, and
+	// removes the objects without a service account
+	require.NoError(t, o.garbageCollect(context.Background()))
+	assert.Contains(t, requests, "LIST tenant-a /v1/aws/roles")
+	assert.Contains(t, requests, "DELETE tenant-a /v1/aws/roles/vkcc_aws_foo_orphan")
+	assert.NotContains(t, existing, "tenant-a /v1/aws/roles/vkcc_aws_foo_orphan")
+	assert.True(t, existing["tenant-a /v1/aws/roles/vkcc_aws_foo_allowed"])
+
+	// The service account is moved to the default namespace, and its
+	// objects are removed from the recorded one
+	_, err = o.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "foo", Name: "allowed"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		" /v1/aws/roles/vkcc_aws_foo_allowed":            true,
+		" /v1/auth/kubernetes/role/vkcc_aws_foo_allowed": true,
+		" /v1/sys/policies/acl/vkcc_aws_foo_allowed":     true,
+	}, existing)
+
+	serviceAccount := &corev1.ServiceAccount{}
+	require.NoError(t, kubeClient.Get(context.Background(), types.NamespacedName{Namespace: "foo", Name: "allowed"}, serviceAccount))
+	assert.NotContains(t, serviceAccount.Annotations, "vault.uw.systems/aws-vault-namespace")
+	assert.Equal(t, "Synced", serviceAccount.Annotations["vault.uw.systems/aws-sync-status"])
+}
+
+// TestOperatorGarbageCollect tests that the objects of keys without an admitted
+// service account are removed from vault, and that a key which can't be
+// removed doesn't stop the others from being collected
+func TestOperatorGarbageCollect(t *testing.T) {
+	lists := map[string][]string{
+		"/v1/aws/roles":            {"vkcc_aws_foo_kept", "vkcc_aws_foo_gone", "vkcc_aws_foo_broken"},
+		"/v1/auth/kubernetes/role": {"vkcc_aws_foo_kept", "vkcc_aws_foo_gone", "vkcc_aws_foo_broken", "other"},
+		"/v1/sys/policy":           {"default", "root", "vkcc_aws_foo_kept", "vkcc_aws_foo_gone", "vkcc_gcp_foo_gone"},
+	}
+
+	var requests []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list") == "true" {
+			requests = append(requests, "LIST "+r.URL.Path)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": lists[r.URL.Path]}})
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/v1/aws/roles/vkcc_aws_foo_broken" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The objects of the listed keys exist, apart from the
+		// policy of the service account that's gone
+		if r.Method == http.MethodGet && r.URL.Path != "/v1/sys/policies/acl/vkcc_aws_foo_gone" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{}})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewClientBuilder().
+		WithObjects(
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "kept",
+					Namespace: "foo",
+					Annotations: map[string]string{
+						awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+					},
+				},
+			},
+		).
+		Build()
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	o, _ := NewOperator(&Config{
+		KubeClient:            kubeClient,
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	collected := testutil.ToFloat64(promGarbageCollected.WithLabelValues("aws"))
+
+	err = o.garbageCollect(context.Background())
+	assert.EqualError(t, err, "error removing vkcc_aws_foo_broken: Error making API request.\n\nURL: GET "+vaultSrv.URL+"/v1/aws/roles/vkcc_aws_foo_broken\nCode: 400. Raw Message:\n\n")
+	assert.Equal(t, []string{
+		"LIST /v1/aws/roles",
+		"LIST /v1/auth/kubernetes/role",
+		"LIST /v1/sys/policy",
+		"GET /v1/aws/roles/vkcc_aws_foo_gone",
+		"GET /v1/auth/kubernetes/role/vkcc_aws_foo_gone",
+		"GET /v1/sys/policies/acl/vkcc_aws_foo_gone",
+		"DELETE /v1/aws/roles/vkcc_aws_foo_gone",
+		"DELETE /v1/auth/kubernetes/role/vkcc_aws_foo_gone",
+		"GET /v1/aws/roles/vkcc_aws_foo_broken",
+	}, requests)
+	assert.Equal(t, collected+1, testutil.ToFloat64(promGarbageCollected.WithLabelValues("aws")))
+}
+
+// TestOperatorStart tests that a failed garbage collection doesn't stop the
+// operator, and that drift repair reconciles every service account
+// periodically
+func TestOperatorStart(t *testing.T) {
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer vaultSrv.Close()
+
+	vaultConfig := vault.DefaultConfig()
+	vaultConfig.Address = vaultSrv.URL
+	vaultClient, err := vault.NewClient(vaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	o, _ := NewOperator(&Config{
+		DriftRepairInterval:   10 * time.Millisecond,
+		KubeClient:            fake.NewClientBuilder().Build(),
+		KubernetesAuthBackend: "kubernetes",
+		Prefix:                "vkcc",
+		VaultClient:           vaultClient,
+		VaultConfig:           vaultConfig,
+	}, aws)
+
+	failed := testutil.ToFloat64(promGarbageCollections.WithLabelValues("aws", garbageCollectionResultError))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- o.Start(ctx)
+	}()
+
+	select {
+	case <-o.reconcileAll:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drift repair didn't reconcile the service accounts")
+	}
+	assert.Equal(t, failed+1, testutil.ToFloat64(promGarbageCollections.WithLabelValues("aws", garbageCollectionResultError)))
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// annotatedServiceAccount returns a service account in the namespace with the
+// identity in the given annotation
+func annotatedServiceAccount(namespace, annotation, identity string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "foo",
+			Namespace:   namespace,
+			Annotations: map[string]string{annotation: identity},
+		},
+	}
+}
+
+// matchRule returns the rule of the provider that admits the service account,
+// in a namespace without labels
+func matchRule(t *testing.T, p provider, serviceAccount *corev1.ServiceAccount) matchedRule {
+	t.Helper()
+
+	rule, err := p.matchRule(serviceAccount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rule
 }
@@ -0,0 +1,143 @@
+package operator
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/hcl"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// extraPoliciesAnnotation lists existing vault policies, separated by commas,
+// that are attached to the kubernetes auth role of a service account as well
+// as its own policy
+const extraPoliciesAnnotation = "vault.uw.systems/extra-policies"
+
+// policyTemplateData are the variables that the policy templates are rendered
+// with
+type policyTemplateData struct {
+	// Namespace and ServiceAccount are the namespace and name of the service
+	// account
+	Namespace      string
+	ServiceAccount string
+	// Name is the key of the objects in vault
+	Name string
+	// Path is the mount path of the secret backend
+	Path string
+}
+
+// parsePolicyTemplate parses a policy template and checks that it renders
+// valid HCL, so that a broken template fails when the config is loaded rather
+// than when a service account is reconciled
+func parsePolicyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("policy").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := renderPolicy(tmpl, policyTemplateData{
+		Namespace:      "namespace",
+		ServiceAccount: "service-account",
+		Name:           "name",
+		Path:           "path",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := hcl.Parse(policy); err != nil {
+		return nil, fmt.Errorf("policy isn't valid HCL: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// parseProviderPolicyTemplate parses the policy template of a provider, which
+// is the given default unless the config file sets one
+func parseProviderPolicyTemplate(defaultText, text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+
+	return parsePolicyTemplate(text)
+}
+
+// renderPolicy renders a policy template with the given variables
+func renderPolicy(tmpl *template.Template, data policyTemplateData) (string, error) {
+	var policy bytes.Buffer
+	if err := tmpl.Execute(&policy, data); err != nil {
+		return "", err
+	}
+
+	return policy.String(), nil
+}
+
+// extraPolicies returns the policies in the extra-policies annotation of the
+// service account
+func extraPolicies(serviceAccount *corev1.ServiceAccount) []string {
+	var policies []string
+	for _, policy := range strings.Split(serviceAccount.Annotations[extraPoliciesAnnotation], ",") {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies
+}
+
+// rolePolicies returns the policies of the kubernetes auth role with the given
+// name, which are the default policy, its own policy and the extra policies of
+// the service account
+func rolePolicies(name string, serviceAccount *corev1.ServiceAccount) []string {
+	return append([]string{"default", name}, extraPolicies(serviceAccount)...)
+}
+
+// checkManagedPolicies returns an error naming the extra policies of the
+// service account that start with the prefix of the policies that the operator
+// writes for service accounts
+func checkManagedPolicies(serviceAccount *corev1.ServiceAccount, prefix string) error {
+	var denied []string
+	for _, policy := range extraPolicies(serviceAccount) {
+		if strings.HasPrefix(policy, prefix+"_") {
+			denied = append(denied, policy)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("extra policies %s aren't allowed, the policies starting with %s_ belong to service accounts", strings.Join(denied, ","), prefix)
+}
+
+// checkExtraPolicies returns an error naming the extra policies of the service
+// account that don't match any of the allowed patterns. Extra policies are
+// only allowed by a rule that lists them.
+func checkExtraPolicies(serviceAccount *corev1.ServiceAccount, allowedPatterns []string) error {
+	var denied []string
+	for _, policy := range extraPolicies(serviceAccount) {
+		allowed := false
+		for _, pattern := range allowedPatterns {
+			match, err := filepath.Match(pattern, policy)
+			if err != nil {
+				return err
+			}
+			if match {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			denied = append(denied, policy)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	if len(allowedPatterns) == 0 {
+		return fmt.Errorf("extra policies %s aren't allowed", strings.Join(denied, ","))
+	}
+
+	return fmt.Errorf("extra policies %s aren't allowed, the allowed policies are %s", strings.Join(denied, ","), strings.Join(allowedPatterns, ","))
+}
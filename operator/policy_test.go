@@ -0,0 +1,137 @@
+package operator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicyTemplate(t *testing.T) {
+	for _, text := range []string{awsPolicyTemplate, gcpPolicyTemplate, azurePolicyTemplate} {
+		_, err := parsePolicyTemplate(text)
+		assert.NoError(t, err)
+	}
+
+	// Test that templates which don't parse, or which don't render valid
+	// HCL, are rejected
+	_, err := parsePolicyTemplate(`path "{{ .Path }/creds/{{ .Name }}" {}`)
+	assert.Error(t, err)
+	_, err = parsePolicyTemplate(`path "{{ .Path }}/creds/{{ .Name }}" { capabilities = ["read"]`)
+	assert.Error(t, err)
+	_, err = parsePolicyTemplate(`path "{{ .Path }}/creds/{{ .Unknown }}" {}`)
+	assert.Error(t, err)
+}
+
+func TestRulePolicyTemplate(t *testing.T) {
+	aws, _ := NewAWSProvider(awsFileConfig{
+		Path: "aws",
+		PolicyTemplate: `
+path "{{ .Path }}/sts/{{ .Name }}" {
+  capabilities = ["read"]
+}
+`,
+		Rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"kv-*"},
+				RoleNamePatterns:  []string{"*"},
+				PolicyTemplate: `
+path "{{ .Path }}/sts/{{ .Name }}" {
+  capabilities = ["read"]
+}
+path "kv/data/{{ .Namespace }}/{{ .ServiceAccount }}/*" {
+  capabilities = ["read"]
+}
+`,
+			},
+			AWSRule{
+				NamespacePatterns: []string{"*"},
+				RoleNamePatterns:  []string{"*"},
+			},
+		},
+	})
+
+	// Test that the template of the provider is used by default
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	policy, err := aws.renderPolicyTemplate("vkcc_aws_foo_foo", serviceAccount, matchRule(t, aws, serviceAccount))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "\npath \"aws/sts/vkcc_aws_foo_foo\" {\n  capabilities = [\"read\"]\n}\n", policy)
+	}
+
+	// Test that the template of the rule that admits the service account
+	// is used instead
+	serviceAccount = annotatedServiceAccount("kv-foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	policy, err = aws.renderPolicyTemplate("vkcc_aws_kv-foo_foo", serviceAccount, matchRule(t, aws, serviceAccount))
+	if assert.NoError(t, err) {
+		assert.Contains(t, policy, `path "aws/sts/vkcc_aws_kv-foo_foo"`)
+		assert.Contains(t, policy, `path "kv/data/kv-foo/foo/*"`)
+	}
+}
+
+func TestExtraPolicies(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	serviceAccount.Annotations[extraPoliciesAnnotation] = "pki-issue, kv-read"
+	assert.Equal(t, []string{"default", "vkcc_aws_foo_foo", "pki-issue", "kv-read"}, rolePolicies("vkcc_aws_foo_foo", serviceAccount))
+
+	// Test that extra policies are denied without rules to allow them
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/foo was denied by aws.rules: extra policies pki-issue,kv-read aren't allowed", o.deniedReason(serviceAccount))
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns:    []string{"foo"},
+			RoleNamePatterns:     []string{"foo"},
+			AllowedExtraPolicies: []string{"pki-*"},
+		},
+		AWSRule{
+			NamespacePatterns:    []string{"*"},
+			RoleNamePatterns:     []string{"*"},
+			AllowedExtraPolicies: []string{"*"},
+		},
+	}
+
+	// Test that the rule which allows the role decides the extra policies,
+	// and that one denied policy denies the service account
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/foo was denied by aws.rules: extra policies kv-read aren't allowed, the allowed policies are pki-*", o.deniedReason(serviceAccount))
+
+	serviceAccount.Annotations[extraPoliciesAnnotation] = "pki-issue"
+	assert.True(t, o.admitEvent(serviceAccount))
+
+	delete(serviceAccount.Annotations, extraPoliciesAnnotation)
+	assert.True(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, []string{"default", "vkcc_aws_foo_foo"}, rolePolicies("vkcc_aws_foo_foo", serviceAccount))
+}
+
+// TestExtraPoliciesManaged tests that the policies of other service accounts
+// can't be attached as extra policies, whichever patterns the rules allow
+func TestExtraPoliciesManaged(t *testing.T) {
+	fc := &fileConfig{}
+	config := &Config{Prefix: "vkcc"}
+	aws, _ := NewAWSProvider(fc.AWS)
+	o, _ := NewOperator(config, aws)
+
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns:    []string{"*"},
+			RoleNamePatterns:     []string{"*"},
+			AllowedExtraPolicies: []string{"*"},
+		},
+	}
+
+	serviceAccount := annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	serviceAccount.Annotations[extraPoliciesAnnotation] = "pki-issue, vkcc_aws_bar_admin"
+	assert.False(t, o.admitEvent(serviceAccount))
+	assert.Equal(t, "vault.uw.systems/aws-role arn:aws:iam::111111111111:role/foo was denied by aws.rules: extra policies vkcc_aws_bar_admin aren't allowed, the policies starting with vkcc_ belong to service accounts", o.deniedReason(serviceAccount))
+
+	aws.Rules[0].AllowedExtraPolicies = []string{"vkcc_*"}
+	assert.False(t, o.admitEvent(serviceAccount))
+
+	serviceAccount.Annotations[extraPoliciesAnnotation] = "pki-issue"
+	aws.Rules[0].AllowedExtraPolicies = []string{"*"}
+	assert.True(t, o.admitEvent(serviceAccount))
+}
@@ -0,0 +1,76 @@
+package operator
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// LabelSelector is a standard kubernetes label selector that can also be read
+// from the config file
+type LabelSelector metav1.LabelSelector
+
+// UnmarshalYAML reads the selector with the field names that kubernetes uses,
+// which the yaml package doesn't derive from the json tags
+func (ls *LabelSelector) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s struct {
+		MatchLabels      map[string]string `yaml:"matchLabels"`
+		MatchExpressions []struct {
+			Key      string   `yaml:"key"`
+			Operator string   `yaml:"operator"`
+			Values   []string `yaml:"values"`
+		} `yaml:"matchExpressions"`
+	}
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	*ls = LabelSelector{MatchLabels: s.MatchLabels}
+	for _, e := range s.MatchExpressions {
+		ls.MatchExpressions = append(ls.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      e.Key,
+			Operator: metav1.LabelSelectorOperator(e.Operator),
+			Values:   e.Values,
+		})
+	}
+
+	return nil
+}
+
+// validate checks that the selector can be parsed, naming the field it's in
+// in the error
+func (ls *LabelSelector) validate(field string) error {
+	if ls == nil {
+		return nil
+	}
+	if _, err := metav1.LabelSelectorAsSelector((*metav1.LabelSelector)(ls)); err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+
+	return nil
+}
+
+// matches returns true if the selector matches the given labels, or if there
+// isn't a selector. As in kubernetes, an empty selector matches everything.
+func (ls *LabelSelector) matches(set map[string]string) (bool, error) {
+	if ls == nil {
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector((*metav1.LabelSelector)(ls))
+	if err != nil {
+		return false, err
+	}
+
+	return selector.Matches(labels.Set(set)), nil
+}
+
+// DeepCopy returns a deep copy of the receiver
+func (ls *LabelSelector) DeepCopy() *LabelSelector {
+	if ls == nil {
+		return nil
+	}
+
+	return (*LabelSelector)((*metav1.LabelSelector)(ls).DeepCopy())
+}
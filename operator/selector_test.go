@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// TestNamespaceSelector tests that rules select namespaces by their labels and
+// that a change to the labels of a namespace enqueues its annotated service
+// accounts
+func TestNamespaceSelector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	payments := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "payments",
+			Labels: map[string]string{"team": "payments"},
+		},
+	}
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			payments,
+			&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "billing",
+					Labels: map[string]string{"team": "billing"},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "annotated",
+					Namespace: "payments",
+					Annotations: map[string]string{
+						gcpServiceAccountAnnotation: "foo@payments.iam.gserviceaccount.com",
+					},
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "not-annotated",
+					Namespace: "payments",
+				},
+			},
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "annotated",
+					Namespace: "billing",
+					Annotations: map[string]string{
+						gcpServiceAccountAnnotation: "foo@payments.iam.gserviceaccount.com",
+					},
+				},
+			},
+		).
+		Build()
+
+	gcp, _ := NewGCPProvider(defaultFileConfig.GCP)
+	gcp.Rules = GCPRules{
+		GCPRule{
+			NamespaceSelector: &LabelSelector{
+				MatchLabels: map[string]string{"team": "payments"},
+			},
+			ServiceAccEmailPatterns: []string{"*@payments.iam.gserviceaccount.com"},
+		},
+	}
+	o, _ := NewOperator(&Config{KubeClient: kubeClient}, gcp)
+
+	// Test that the namespace patterns aren't required with a selector
+	assert.True(t, o.admitEvent(annotatedServiceAccount("payments", gcpServiceAccountAnnotation, "foo@payments.iam.gserviceaccount.com")))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("billing", gcpServiceAccountAnnotation, "foo@payments.iam.gserviceaccount.com")))
+
+	// Test that a namespace that doesn't exist has no labels
+	assert.False(t, o.admitEvent(annotatedServiceAccount("missing", gcpServiceAccountAnnotation, "foo@payments.iam.gserviceaccount.com")))
+
+	// Test that the patterns still apply with a selector
+	gcp.Rules[0].NamespacePatterns = []string{"billing"}
+	assert.False(t, o.admitEvent(annotatedServiceAccount("payments", gcpServiceAccountAnnotation, "foo@payments.iam.gserviceaccount.com")))
+	gcp.Rules[0].NamespacePatterns = nil
+
+	// Test that the annotated service accounts in a namespace are enqueued
+	// when it changes
+	requests := o.namespaceChanged(context.Background(), payments)
+	assert.Equal(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "payments", Name: "annotated"}},
+	}, requests)
+
+	// Test that access is revoked when the namespace leaves the team
+	payments.Labels = map[string]string{"team": "billing"}
+	assert.NoError(t, kubeClient.Update(context.Background(), payments))
+	assert.False(t, o.admitEvent(annotatedServiceAccount("payments", gcpServiceAccountAnnotation, "foo@payments.iam.gserviceaccount.com")))
+}
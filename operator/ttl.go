@@ -0,0 +1,139 @@
+package operator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Duration is a time.Duration that is written as a string like 1h, both in the
+// config file and in access rule resources
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML parses the duration from a string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+// UnmarshalJSON parses the duration from a string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) parse(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+
+	return nil
+}
+
+// ttlBounds are the default ttl of the credentials for a service account and
+// the bounds of the ttl that it can set in its annotation
+type ttlBounds struct {
+	defaultTTL time.Duration
+	minTTL     time.Duration
+	// maxTTL is unbounded if it's 0
+	maxTTL time.Duration
+}
+
+// withRule overrides the bounds with those that are set on the rule that
+// admitted a service account
+func (b ttlBounds) withRule(rule matchedRule) ttlBounds {
+	if rule.defaultTTL.Duration > 0 {
+		b.defaultTTL = rule.defaultTTL.Duration
+	}
+	if rule.minTTL.Duration > 0 {
+		b.minTTL = rule.minTTL.Duration
+	}
+	if rule.maxTTL.Duration > 0 {
+		b.maxTTL = rule.maxTTL.Duration
+	}
+
+	return b
+}
+
+// secretTTL returns the ttl in the given annotation of the service account, or
+// the default ttl if it isn't set. The default is kept within the bounds, so
+// that a rule can narrow the bounds without setting its own default.
+func (b ttlBounds) secretTTL(serviceAccount *corev1.ServiceAccount, annotation string) (time.Duration, error) {
+	name := strings.TrimPrefix(annotation, "vault.uw.systems/")
+
+	v, ok := serviceAccount.Annotations[annotation]
+	if !ok {
+		secretTTL := b.defaultTTL
+		if secretTTL < b.minTTL {
+			secretTTL = b.minTTL
+		}
+		if b.maxTTL > 0 && secretTTL > b.maxTTL {
+			secretTTL = b.maxTTL
+		}
+		return secretTTL, nil
+	}
+
+	secretTTL, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s %w", name, err)
+	}
+	if secretTTL < b.minTTL {
+		return 0, fmt.Errorf("minimum %s value allowed is %s, its set to %s", name, b.minTTL, secretTTL)
+	}
+	if b.maxTTL > 0 && secretTTL > b.maxTTL {
+		return 0, fmt.Errorf("maximum %s value allowed is %s, its set to %s", name, b.maxTTL, secretTTL)
+	}
+
+	return secretTTL, nil
+}
+
+// validateTTLs checks that the ttl settings of a rule are consistent, that
+// none of them is less than the given floor and that the maximum doesn't exceed
+// the given limit, if there are any
+func validateTTLs(defaultTTL, minTTL, maxTTL Duration, floor, limit time.Duration) error {
+	if minTTL.Duration < 0 || maxTTL.Duration < 0 || defaultTTL.Duration < 0 {
+		return fmt.Errorf("ttls can't be negative")
+	}
+	for _, ttl := range []struct {
+		name string
+		ttl  Duration
+	}{{"defaultTTL", defaultTTL}, {"minTTL", minTTL}, {"maxTTL", maxTTL}} {
+		if ttl.ttl.Duration > 0 && ttl.ttl.Duration < floor {
+			return fmt.Errorf("%s can't be less than %s", ttl.name, floor)
+		}
+	}
+	if limit > 0 && maxTTL.Duration > limit {
+		return fmt.Errorf("maxTTL can't be more than %s", limit)
+	}
+	if maxTTL.Duration > 0 && minTTL.Duration > maxTTL.Duration {
+		return fmt.Errorf("minTTL %s is more than maxTTL %s", minTTL, maxTTL)
+	}
+	if defaultTTL.Duration > 0 && defaultTTL.Duration < minTTL.Duration {
+		return fmt.Errorf("defaultTTL %s is less than minTTL %s", defaultTTL, minTTL)
+	}
+	if defaultTTL.Duration > 0 && maxTTL.Duration > 0 && defaultTTL.Duration > maxTTL.Duration {
+		return fmt.Errorf("defaultTTL %s is more than maxTTL %s", defaultTTL, maxTTL)
+	}
+
+	return nil
+}
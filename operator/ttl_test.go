@@ -0,0 +1,108 @@
+package operator
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSecretTTLRules tests that the rule that admits a service account decides
+// its default ttl and the ttls it can set
+func TestSecretTTLRules(t *testing.T) {
+	aws, _ := NewAWSProvider(defaultFileConfig.AWS)
+	aws.Rules = AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"prod-*"},
+			RoleNamePatterns:  []string{"*"},
+			MaxTTL:            Duration{time.Hour},
+		},
+		AWSRule{
+			NamespacePatterns: []string{"batch"},
+			RoleNamePatterns:  []string{"*"},
+			DefaultTTL:        Duration{6 * time.Hour},
+			MinTTL:            Duration{time.Hour},
+		},
+		AWSRule{
+			NamespacePatterns: []string{"*"},
+			RoleNamePatterns:  []string{"*"},
+		},
+	}
+
+	serviceAccount := annotatedServiceAccount("prod-foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	ttl, err := aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, ttl)
+
+	// Test that the maximum of the rule applies
+	serviceAccount.Annotations[defaultSTSTTLAnnotation] = "2h"
+	_, err = aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.EqualError(t, err, "maximum default-sts-ttl value allowed is 1h0m0s, its set to 2h0m0s")
+
+	// Test that the default and minimum of the rule apply
+	serviceAccount = annotatedServiceAccount("batch", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	ttl, err = aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, ttl)
+	serviceAccount.Annotations[defaultSTSTTLAnnotation] = "30m"
+	_, err = aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.EqualError(t, err, "minimum default-sts-ttl value allowed is 1h0m0s, its set to 30m0s")
+
+	// Test that the provider settings apply to rules without ttl settings
+	serviceAccount = annotatedServiceAccount("foo", awsRoleAnnotation, "arn:aws:iam::111111111111:role/foo")
+	serviceAccount.Annotations[defaultSTSTTLAnnotation] = "12h"
+	ttl, err = aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, 12*time.Hour, ttl)
+
+	// Test that the STS minimum applies when the provider allows less
+	aws.MinTTL = time.Minute
+	serviceAccount.Annotations[defaultSTSTTLAnnotation] = "10m"
+	_, err = aws.secretTTL(serviceAccount, matchRule(t, aws, serviceAccount))
+	assert.EqualError(t, err, "minimum default-sts-ttl value allowed is 15m0s, its set to 10m0s")
+
+	gcp, _ := NewGCPProvider(defaultFileConfig.GCP)
+	gcp.Rules = GCPRules{
+		GCPRule{
+			NamespacePatterns:       []string{"prod-*"},
+			ServiceAccEmailPatterns: []string{"*"},
+			MinTTL:                  Duration{2 * time.Hour},
+		},
+	}
+
+	// Test that the default is kept within the bounds of the rule
+	serviceAccount = annotatedServiceAccount("prod-foo", gcpServiceAccountAnnotation, "foo@bar.iam.gserviceaccount.com")
+	ttl, err = gcp.secretTTL(serviceAccount, matchRule(t, gcp, serviceAccount))
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, ttl)
+	serviceAccount.Annotations[defaultGCPKeyTTLAnnotation] = "1h"
+	_, err = gcp.secretTTL(serviceAccount, matchRule(t, gcp, serviceAccount))
+	assert.EqualError(t, err, "minimum default-gcp-key-ttl value allowed is 2h0m0s, its set to 1h0m0s")
+}
+
+func TestValidateTTLs(t *testing.T) {
+	assert.NoError(t, validateTTLs(Duration{time.Hour}, Duration{15 * time.Minute}, Duration{2 * time.Hour}, minSTSTTLDuration, maxSTSTTLDuration))
+	assert.NoError(t, validateTTLs(Duration{}, Duration{}, Duration{}, 0, 0))
+	assert.EqualError(t, validateTTLs(Duration{}, Duration{}, Duration{13 * time.Hour}, minSTSTTLDuration, maxSTSTTLDuration), "maxTTL can't be more than 12h0m0s")
+	assert.EqualError(t, validateTTLs(Duration{}, Duration{2 * time.Hour}, Duration{time.Hour}, 0, 0), "minTTL 2h0m0s is more than maxTTL 1h0m0s")
+	assert.EqualError(t, validateTTLs(Duration{time.Minute}, Duration{time.Hour}, Duration{}, 0, 0), "defaultTTL 1m0s is less than minTTL 1h0m0s")
+	assert.EqualError(t, validateTTLs(Duration{3 * time.Hour}, Duration{}, Duration{time.Hour}, 0, 0), "defaultTTL 3h0m0s is more than maxTTL 1h0m0s")
+	assert.EqualError(t, validateTTLs(Duration{}, Duration{5 * time.Minute}, Duration{}, minSTSTTLDuration, maxSTSTTLDuration), "minTTL can't be less than 15m0s")
+	assert.EqualError(t, validateTTLs(Duration{10 * time.Minute}, Duration{}, Duration{}, minSTSTTLDuration, maxSTSTTLDuration), "defaultTTL can't be less than 15m0s")
+	assert.EqualError(t, validateTTLs(Duration{}, Duration{}, Duration{time.Minute}, minSTSTTLDuration, 0), "maxTTL can't be less than 15m0s")
+}
+
+// TestDurationJSON tests that the ttls of access rule resources are strings
+func TestDurationJSON(t *testing.T) {
+	var rule AWSRule
+	require.NoError(t, json.Unmarshal([]byte(`{"maxTTL":"1h30m"}`), &rule))
+	assert.Equal(t, 90*time.Minute, rule.MaxTTL.Duration)
+
+	b, err := json.Marshal(rule)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"maxTTL":"1h30m0s"}`, string(b))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"maxTTL":"forever"}`), &rule))
+}
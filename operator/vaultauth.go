@@ -0,0 +1,281 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	vaultAuthKubernetes = "kubernetes"
+	vaultAuthJWT        = "jwt"
+	vaultAuthAppRole    = "approle"
+
+	// defaultVaultAuthTokenPath is the token of the service account of the
+	// operator, which is used to log in with the kubernetes and jwt methods
+	// by default
+	defaultVaultAuthTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// minReloginInterval is the shortest time between logins that are
+	// triggered by vault denying requests, so that a policy which is
+	// missing a capability doesn't cause a login for every request
+	minReloginInterval = time.Minute
+)
+
+type vaultAuthFileConfig struct {
+	// Method is the auth method that the operator logs in to vault with,
+	// one of kubernetes, jwt or approle. If it's empty, the token in the
+	// VAULT_TOKEN environment variable is used.
+	Method string `yaml:"method"`
+	// Path is the mount path of the auth backend. Defaults to the name of
+	// the method.
+	Path string `yaml:"path"`
+	// Role is the role to log in as with the kubernetes and jwt methods
+	Role string `yaml:"role"`
+	// TokenPath is the file containing the token to log in with, for the
+	// kubernetes and jwt methods. Defaults to the token of the service
+	// account of the operator.
+	TokenPath string `yaml:"tokenPath"`
+	// RoleID and SecretIDPath, the file containing the secret id, are the
+	// credentials to log in with the approle method
+	RoleID       string `yaml:"roleID"`
+	SecretIDPath string `yaml:"secretIDPath"`
+}
+
+// validate checks that the settings for the auth method are set
+func (c vaultAuthFileConfig) validate() error {
+	switch c.Method {
+	case "":
+		return nil
+	case vaultAuthKubernetes, vaultAuthJWT:
+		if c.Role == "" {
+			return fmt.Errorf("role can't be empty with the %s method", c.Method)
+		}
+	case vaultAuthAppRole:
+		if c.RoleID == "" || c.SecretIDPath == "" {
+			return fmt.Errorf("roleID and secretIDPath can't be empty with the %s method", c.Method)
+		}
+	default:
+		return fmt.Errorf("method must be one of '%s', '%s' or '%s', not '%s'", vaultAuthKubernetes, vaultAuthJWT, vaultAuthAppRole, c.Method)
+	}
+
+	return nil
+}
+
+// vaultAuth logs the vault clients of the operators in with an auth method
+// and keeps their token alive. It logs in again when the token can't be
+// renewed anymore, or when vault denies a request in case the token was
+// revoked.
+type vaultAuth struct {
+	config vaultAuthFileConfig
+
+	mu        sync.Mutex
+	clients   []*vault.Client
+	secret    *vault.Secret
+	lastLogin time.Time
+
+	relogin chan struct{}
+}
+
+func newVaultAuth(config vaultAuthFileConfig) *vaultAuth {
+	return &vaultAuth{
+		config:  config,
+		relogin: make(chan struct{}, 1),
+	}
+}
+
+// noReloginKey is the context key of requests that vault may deny because of
+// the policy of the operator rather than its token
+type noReloginKey struct{}
+
+// withoutRelogin returns a context for requests that don't trigger a login
+// when they're denied
+func withoutRelogin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noReloginKey{}, true)
+}
+
+// transport wraps the transport of a vault client so that a denied request
+// triggers a login
+func (va *vaultAuth) transport(next http.RoundTripper) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(r)
+		if err == nil && resp.StatusCode == http.StatusForbidden && !strings.HasSuffix(r.URL.Path, "/login") && r.Context().Value(noReloginKey{}) == nil {
+			select {
+			case va.relogin <- struct{}{}:
+			default:
+			}
+		}
+
+		return resp, err
+	})
+}
+
+// addClient adds a client to be given the token
+func (va *vaultAuth) addClient(client *vault.Client) {
+	va.mu.Lock()
+	defer va.mu.Unlock()
+
+	va.clients = append(va.clients, client)
+}
+
+// login logs in with the auth method and sets the token on the clients
+func (va *vaultAuth) login(ctx context.Context) error {
+	va.mu.Lock()
+	defer va.mu.Unlock()
+
+	if len(va.clients) == 0 {
+		return fmt.Errorf("there are no vault clients to log in")
+	}
+
+	// The login request is made without the current token, which vault
+	// may reject if it's been revoked, but in the vault namespace of the
+	// client
+	client, err := va.clients[0].CloneWithHeaders()
+	if err != nil {
+		return err
+	}
+	client.ClearToken()
+
+	data, err := va.loginData()
+	if err != nil {
+		return err
+	}
+
+	path := va.config.Path
+	if path == "" {
+		path = va.config.Method
+	}
+	loginPath := "auth/" + path + "/login"
+	secret, err := client.Logical().WriteWithContext(ctx, loginPath, data)
+	if err != nil {
+		return fmt.Errorf("unable to login err:%w", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("no authentication information attached to the response from %s", loginPath)
+	}
+
+	for _, c := range va.clients {
+		c.SetToken(secret.Auth.ClientToken)
+	}
+	va.secret = secret
+	va.lastLogin = time.Now()
+
+	log.Info("logged in to vault", "method", va.config.Method, "lease_duration", time.Duration(secret.Auth.LeaseDuration)*time.Second)
+
+	return nil
+}
+
+// loginData returns the credentials for the auth method. The files are read on
+// every login, so that rotated tokens and secret ids are picked up.
+func (va *vaultAuth) loginData() (map[string]interface{}, error) {
+	if va.config.Method == vaultAuthAppRole {
+		secretID, err := os.ReadFile(va.config.SecretIDPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"role_id":   va.config.RoleID,
+			"secret_id": strings.TrimSpace(string(secretID)),
+		}, nil
+	}
+
+	tokenPath := va.config.TokenPath
+	if tokenPath == "" {
+		tokenPath = defaultVaultAuthTokenPath
+	}
+	jwt, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"role": va.config.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}, nil
+}
+
+// NeedLeaderElection is false so that standby replicas have a valid token when
+// they're elected
+func (va *vaultAuth) NeedLeaderElection() bool {
+	return false
+}
+
+// Start keeps the token alive until the context is cancelled. The first login
+// is made before the manager is started, so that the operators have a token
+// from the start.
+func (va *vaultAuth) Start(ctx context.Context) error {
+	for {
+		va.mu.Lock()
+		watcher, err := va.clients[0].NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: va.secret})
+		va.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		go watcher.Start()
+
+		relogin := va.watch(ctx, watcher)
+		watcher.Stop()
+		if !relogin {
+			return nil
+		}
+
+		backoff := wait.Backoff{
+			Duration: 5 * time.Second,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    math.MaxInt32,
+			Cap:      time.Minute,
+		}
+		for {
+			err := va.login(ctx)
+			if err == nil {
+				break
+			}
+			d := backoff.Step()
+			log.Error(err, "error logging in to vault", "backoff", d)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(d):
+			}
+		}
+	}
+}
+
+// watch waits until the token needs to be replaced, returning false if the
+// context was cancelled first
+func (va *vaultAuth) watch(ctx context.Context, watcher *vault.LifetimeWatcher) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				log.Error(err, "error renewing vault token")
+			}
+			log.Info("vault token can't be renewed anymore, logging in again")
+			return true
+		case <-watcher.RenewCh():
+			log.V(1).Info("vault token renewed")
+		case <-va.relogin:
+			va.mu.Lock()
+			lastLogin := va.lastLogin
+			va.mu.Unlock()
+			if time.Since(lastLogin) < minReloginInterval {
+				continue
+			}
+			log.Info("vault denied a request, logging in again")
+			return true
+		}
+	}
+}
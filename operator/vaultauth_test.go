@@ -0,0 +1,118 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestVaultAuthLogin tests that the clients are given the token from a login
+// with the service account token, and that a denied request triggers another
+// login
+func TestVaultAuthLogin(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var logins []map[string]interface{}
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/k8s/login":
+			assert.Empty(t, r.Header.Get("X-Vault-Token"))
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			logins = append(logins, body)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"auth": map[string]interface{}{
+					"client_token":   "s.token",
+					"lease_duration": 3600,
+					"renewable":      true,
+				},
+			})
+		case "/v1/sys/policy":
+			assert.Equal(t, "s.token", r.Header.Get("X-Vault-Token"))
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vaultSrv.Close()
+
+	va := newVaultAuth(vaultAuthFileConfig{
+		Method:    vaultAuthKubernetes,
+		Path:      "k8s",
+		Role:      "vkcc",
+		TokenPath: tokenPath,
+	})
+
+	var clients []*vault.Client
+	for i := 0; i < 2; i++ {
+		config := vault.DefaultConfig()
+		config.Address = vaultSrv.URL
+		config.HttpClient.Transport = va.transport(config.HttpClient.Transport)
+		client, err := vault.NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetToken("s.stale")
+		va.addClient(client)
+		clients = append(clients, client)
+	}
+
+	assert.NoError(t, va.login(context.Background()))
+	assert.Equal(t, []map[string]interface{}{{"role": "vkcc", "jwt": "jwt"}}, logins)
+	for _, client := range clients {
+		assert.Equal(t, "s.token", client.Token())
+	}
+
+	// Test that a login isn't triggered until a request is denied
+	select {
+	case <-va.relogin:
+		t.Fatal("login triggered without a denied request")
+	default:
+	}
+
+	// Test that a denied read of an object doesn't trigger a login, since
+	// the policy of the operator may not allow reads
+	_, err := clients[1].Logical().ReadWithContext(withoutRelogin(context.Background()), "sys/policy")
+	assert.Error(t, err)
+	select {
+	case <-va.relogin:
+		t.Fatal("login triggered by a denied read of an object")
+	default:
+	}
+
+	_, err = clients[1].Logical().List("sys/policy")
+	assert.Error(t, err)
+	select {
+	case <-va.relogin:
+	default:
+		t.Fatal("login not triggered by a denied request")
+	}
+}
+
+// TestVaultAuthAppRoleLoginData tests that the secret id is read from its file
+func TestVaultAuthAppRoleLoginData(t *testing.T) {
+	secretIDPath := filepath.Join(t.TempDir(), "secret-id")
+	if err := os.WriteFile(secretIDPath, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	va := newVaultAuth(vaultAuthFileConfig{
+		Method:       vaultAuthAppRole,
+		RoleID:       "role",
+		SecretIDPath: secretIDPath,
+	})
+	data, err := va.loginData()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"role_id": "role", "secret_id": "secret"}, data)
+	}
+}
@@ -0,0 +1,308 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// defaultAzureAuthorityHost is the Azure AD endpoint that service principal
+// credentials are exchanged against for access tokens
+const defaultAzureAuthorityHost = "https://login.microsoftonline.com/"
+
+// azureHTTPClient is the client used to request access tokens from Azure AD.
+// The timeout ensures that a slow endpoint can't hold up requests for tokens
+// indefinitely.
+var azureHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// AzureCredentials are the credentials served by the API, in the format
+// returned by the Azure IMDS token endpoint
+type AzureCredentials struct {
+	AccessToken  string `json:"access_token"`
+	ClientID     string `json:"client_id"`
+	ExpiresIn    string `json:"expires_in"`
+	ExpiresOn    string `json:"expires_on"`
+	NotBefore    string `json:"not_before"`
+	RefreshToken string `json:"refresh_token"`
+	Resource     string `json:"resource"`
+	TokenType    string `json:"token_type"`
+
+	// expiresAt is the time that the credentials expire. The duration until
+	// this time is inserted into ExpiresIn when marshalling into JSON.
+	expiresAt time.Time
+}
+
+// MarshalJSON overrides the value of ExpiresIn with the duration until
+// expiresAt
+func (ac *AzureCredentials) MarshalJSON() ([]byte, error) {
+	type Alias AzureCredentials
+	return json.Marshal(&struct {
+		ExpiresIn string `json:"expires_in"`
+		*Alias
+	}{
+		ExpiresIn: strconv.Itoa(int(time.Until(ac.expiresAt).Seconds())),
+		Alias:     (*Alias)(ac),
+	})
+}
+
+// azureError is the format of errors returned by the Azure IMDS token endpoint
+type azureError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// write populates the error fields and writes itself to the http response. The
+// code is converted from the form returned by http.StatusText ("Bad Request")
+// into the form expected in the response ("bad_request") unless the error has
+// already been set
+func (e *azureError) write(w http.ResponseWriter, msg string, code int) error {
+	if e.Error == "" {
+		e.Error = strings.ReplaceAll(strings.ToLower(http.StatusText(code)), " ", "_")
+	}
+	e.ErrorDescription = msg
+
+	w.Header().Set("Content-Type", "application/json")
+
+	return json.NewEncoder(w).Encode(e)
+}
+
+// azureServicePrincipal is the service principal issued by vault
+type azureServicePrincipal struct {
+	clientID     string
+	clientSecret string
+}
+
+// azureTokenResponse is the response from the Azure AD token endpoint
+type azureTokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+	ExpiresOn   json.Number `json:"expires_on"`
+	NotBefore   json.Number `json:"not_before"`
+	Resource    string      `json:"resource"`
+	TokenType   string      `json:"token_type"`
+}
+
+// AzureProviderConfig provides methods that allow the sidecar to retrieve
+// service principal credentials from vault for the given configuration and
+// serve access tokens for them, masquerading as the Azure IMDS endpoint
+type AzureProviderConfig struct {
+	AuthorityHost string
+	Path          string
+	Role          string
+	TenantID      string
+
+	mu             sync.Mutex
+	sp             *azureServicePrincipal
+	tokens         map[string]*AzureCredentials
+	leaseID        string
+	leaseDuration  time.Duration
+	leaseExpiresAt time.Time
+}
+
+// renew retrieves credentials from vault for the secret indicated in the
+// configuration. Creating a service principal is slow and it can take a while
+// for it to propagate in Azure AD, so rather than requesting new credentials
+// each time, the lease of the current credentials is renewed until it expires.
+func (azpc *AzureProviderConfig) renew(ctx context.Context, client *vault.Client) (time.Duration, error) {
+	if azpc.leaseID == "" || time.Since(azpc.leaseExpiresAt) > 0 {
+		return azpc.newCredentials(ctx, client)
+	}
+
+	secret, err := client.Sys().RenewWithContext(ctx, azpc.leaseID, int(azpc.leaseDuration.Seconds()))
+	if err != nil {
+		// The lease may have been revoked in vault, in which case it
+		// will never renew, so fall back to new credentials
+		log.Error(err, "unable to renew azure credentials lease, requesting new credentials")
+		return azpc.newCredentials(ctx, client)
+	}
+
+	azpc.leaseDuration = time.Duration(secret.LeaseDuration) * time.Second
+	azpc.leaseExpiresAt = time.Now().Add(azpc.leaseDuration)
+
+	log.Info("azure credentials lease renewed",
+		"lease_expiration", azpc.leaseExpiresAt.Format("2006-01-02 15:04:05"),
+	)
+
+	return azpc.leaseDuration, nil
+}
+
+func (azpc *AzureProviderConfig) newCredentials(ctx context.Context, client *vault.Client) (time.Duration, error) {
+	secret, err := client.Logical().ReadWithContext(ctx, azpc.Path+"/creds/"+azpc.Role)
+	if err != nil {
+		return -1, fmt.Errorf("unable to get new azure credentials err:%w", err)
+	}
+	if secret == nil {
+		return -1, errors.New("secret returned by vault client is nil")
+	}
+
+	clientID, ok := secret.Data["client_id"].(string)
+	if !ok {
+		return -1, fmt.Errorf("client_id is not a string")
+	}
+	clientSecret, ok := secret.Data["client_secret"].(string)
+	if !ok {
+		return -1, fmt.Errorf("client_secret is not a string")
+	}
+
+	azpc.mu.Lock()
+	azpc.sp = &azureServicePrincipal{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+	}
+	// Tokens issued for the previous service principal are dropped
+	azpc.tokens = map[string]*AzureCredentials{}
+	azpc.mu.Unlock()
+
+	azpc.leaseDuration = time.Duration(secret.LeaseDuration) * time.Second
+	azpc.leaseExpiresAt = time.Now().Add(azpc.leaseDuration)
+	azpc.leaseID = secret.LeaseID
+
+	log.Info("new azure credentials",
+		"client_id", clientID,
+		"lease_expiration", azpc.leaseExpiresAt.Format("2006-01-02 15:04:05"),
+	)
+
+	return azpc.leaseDuration, nil
+}
+
+// token returns an access token for the given resource, exchanging the service
+// principal credentials with Azure AD if there isn't a cached token that is
+// valid for at least another 5 minutes
+func (azpc *AzureProviderConfig) token(ctx context.Context, resource string) (*AzureCredentials, error) {
+	azpc.mu.Lock()
+	sp := azpc.sp
+	t, ok := azpc.tokens[resource]
+	azpc.mu.Unlock()
+
+	if sp == nil {
+		return nil, nil
+	}
+
+	if ok && time.Until(t.expiresAt) > 5*time.Minute {
+		return t, nil
+	}
+
+	// The lock isn't held while the token is requested so that requests for
+	// other resources aren't blocked by a slow response from Azure AD
+	t, err := azpc.requestToken(ctx, sp, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	azpc.mu.Lock()
+	// Don't cache tokens for a service principal that has since been
+	// replaced
+	if azpc.sp == sp {
+		azpc.tokens[resource] = t
+	}
+	azpc.mu.Unlock()
+
+	log.Info("new azure access token",
+		"resource", resource,
+		"expiration", t.expiresAt.Format("2006-01-02 15:04:05"),
+	)
+
+	return t, nil
+}
+
+// requestToken exchanges the service principal credentials with Azure AD for
+// an access token for the given resource
+func (azpc *AzureProviderConfig) requestToken(ctx context.Context, sp *azureServicePrincipal, resource string) (*AzureCredentials, error) {
+	authorityHost := azpc.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = defaultAzureAuthorityHost
+	}
+	tokenURL := strings.TrimSuffix(authorityHost, "/") + "/" + url.PathEscape(azpc.TenantID) + "/oauth2/token"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {sp.clientID},
+		"client_secret": {sp.clientSecret},
+		"resource":      {resource},
+	}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := azureHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected response from azure ad token endpoint: %s: %s", resp.Status, body)
+	}
+
+	tr := &azureTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+		return nil, err
+	}
+
+	expiresOn, err := tr.ExpiresOn.Int64()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureCredentials{
+		AccessToken: tr.AccessToken,
+		ClientID:    sp.clientID,
+		ExpiresOn:   tr.ExpiresOn.String(),
+		NotBefore:   tr.NotBefore.String(),
+		Resource:    resource,
+		TokenType:   tr.TokenType,
+		expiresAt:   time.Unix(expiresOn, 0),
+	}, nil
+}
+
+// setupEndpoints adds the endpoints required to masquerade as the Azure IMDS
+// managed identity token endpoint
+func (azpc *AzureProviderConfig) setupEndpoints(r *mux.Router) {
+	r.HandleFunc("/metadata/identity/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		// IMDS rejects requests without the Metadata header to guard
+		// against SSRF
+		if r.Header.Get("Metadata") != "true" {
+			httpError(w, "Required metadata header not specified", http.StatusBadRequest, &azureError{Error: "invalid_request"})
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			httpError(w, "Can't parse query arguments", http.StatusBadRequest, &azureError{Error: "invalid_request"})
+			return
+		}
+		resource := r.Form.Get("resource")
+		if resource == "" {
+			httpError(w, "Required audience not specified", http.StatusBadRequest, &azureError{Error: "invalid_request"})
+			return
+		}
+
+		t, err := azpc.token(r.Context(), resource)
+		if err != nil {
+			log.Error(err, "error retrieving azure access token", "resource", resource)
+			httpError(w, "Error retrieving access token for resource", http.StatusBadRequest, &azureError{Error: "invalid_resource"})
+			return
+		}
+		if t == nil {
+			httpError(w, "Credentials not initialized", http.StatusNotFound, &azureError{})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t); err != nil {
+			httpError(w, "Error encoding credentials response as json", http.StatusInternalServerError, &azureError{})
+			return
+		}
+	})
+}
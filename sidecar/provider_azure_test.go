@@ -0,0 +1,197 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestVaultClient returns a vault client for the given test server
+func newTestVaultClient(t *testing.T, srv *httptest.Server) *vault.Client {
+	config := vault.DefaultConfig()
+	config.Address = srv.URL
+	config.MaxRetries = 0
+	client, err := vault.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// writeAzureCreds writes a secret response with a new service principal
+func writeAzureCreds(w http.ResponseWriter, clientID string) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_id":       "azure/creds/foo/" + clientID,
+		"lease_duration": 3600,
+		"renewable":      true,
+		"data": map[string]interface{}{
+			"client_id":     clientID,
+			"client_secret": "secret",
+		},
+	})
+}
+
+// TestAzureToken tests that access tokens are cached per resource until they
+// are close to expiry
+func TestAzureToken(t *testing.T) {
+	expiresIn := time.Hour
+	var requests []string
+	azureSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tenant/oauth2/token", r.URL.Path)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		assert.Equal(t, "client", r.Form.Get("client_id"))
+		assert.Equal(t, "secret", r.Form.Get("client_secret"))
+		requests = append(requests, r.Form.Get("resource"))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token-" + strconv.Itoa(len(requests)),
+			"expires_on":   strconv.FormatInt(time.Now().Add(expiresIn).Unix(), 10),
+			"not_before":   strconv.FormatInt(time.Now().Unix(), 10),
+			"resource":     r.Form.Get("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	defer azureSrv.Close()
+
+	azpc := &AzureProviderConfig{
+		AuthorityHost: azureSrv.URL,
+		TenantID:      "tenant",
+	}
+
+	// No token is returned before there are credentials
+	tok, err := azpc.token(context.Background(), "https://vault.azure.net")
+	assert.NoError(t, err)
+	assert.Nil(t, tok)
+
+	azpc.sp = &azureServicePrincipal{clientID: "client", clientSecret: "secret"}
+	azpc.tokens = map[string]*AzureCredentials{}
+
+	tok, err = azpc.token(context.Background(), "https://vault.azure.net")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", tok.AccessToken)
+	assert.Equal(t, "client", tok.ClientID)
+
+	// A cached token is returned for the same resource
+	tok, err = azpc.token(context.Background(), "https://vault.azure.net")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", tok.AccessToken)
+
+	// Another resource requires another token
+	tok, err = azpc.token(context.Background(), "https://storage.azure.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", tok.AccessToken)
+
+	assert.Equal(t, []string{"https://vault.azure.net", "https://storage.azure.com"}, requests)
+
+	// A token that expires within 5 minutes is replaced
+	azpc.tokens["https://vault.azure.net"].expiresAt = time.Now().Add(4 * time.Minute)
+	tok, err = azpc.token(context.Background(), "https://vault.azure.net")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", tok.AccessToken)
+	assert.Len(t, requests, 3)
+}
+
+// TestAzureTokenError tests that an error from Azure AD is returned and
+// nothing is cached
+func TestAzureTokenError(t *testing.T) {
+	azureSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer azureSrv.Close()
+
+	azpc := &AzureProviderConfig{
+		AuthorityHost: azureSrv.URL,
+		TenantID:      "tenant",
+		sp:            &azureServicePrincipal{clientID: "client", clientSecret: "secret"},
+		tokens:        map[string]*AzureCredentials{},
+	}
+
+	_, err := azpc.token(context.Background(), "https://vault.azure.net")
+	assert.Error(t, err)
+	assert.Empty(t, azpc.tokens)
+}
+
+// TestAzureRenew tests that the lease is renewed while it's valid, and that new
+// credentials are requested when the lease has expired or can't be renewed
+func TestAzureRenew(t *testing.T) {
+	renewStatus := http.StatusOK
+	var requests []string
+	vaultSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/v1/azure/creds/foo":
+			writeAzureCreds(w, "client-"+strconv.Itoa(len(requests)))
+		case "/v1/sys/leases/renew":
+			if renewStatus != http.StatusOK {
+				w.WriteHeader(renewStatus)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"lease_id":       "azure/creds/foo/client-1",
+				"lease_duration": 1800,
+				"renewable":      true,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vaultSrv.Close()
+
+	client := newTestVaultClient(t, vaultSrv)
+
+	azpc := &AzureProviderConfig{
+		Path: "azure",
+		Role: "foo",
+	}
+
+	// The first renewal requests new credentials
+	d, err := azpc.renew(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+	assert.Equal(t, "client-1", azpc.sp.clientID)
+	assert.Equal(t, "azure/creds/foo/client-1", azpc.leaseID)
+
+	// Tokens are dropped when the service principal changes, so add one to
+	// check that a renewal keeps it
+	azpc.tokens["https://vault.azure.net"] = &AzureCredentials{}
+
+	// Subsequent renewals renew the lease
+	d, err = azpc.renew(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, d)
+	assert.Equal(t, "client-1", azpc.sp.clientID)
+	assert.Len(t, azpc.tokens, 1)
+
+	// When the lease can't be renewed, new credentials are requested
+	renewStatus = http.StatusBadRequest
+	d, err = azpc.renew(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+	assert.Equal(t, "client-4", azpc.sp.clientID)
+	assert.Empty(t, azpc.tokens)
+
+	// When the lease has expired, new credentials are requested without
+	// attempting a renewal
+	renewStatus = http.StatusOK
+	azpc.leaseExpiresAt = time.Now().Add(-time.Second)
+	d, err = azpc.renew(context.Background(), client)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d)
+	assert.Equal(t, "client-5", azpc.sp.clientID)
+
+	assert.Equal(t, []string{
+		"/v1/azure/creds/foo",
+		"/v1/sys/leases/renew",
+		"/v1/sys/leases/renew",
+		"/v1/azure/creds/foo",
+		"/v1/azure/creds/foo",
+	}, requests)
+}
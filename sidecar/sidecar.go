@@ -26,6 +26,9 @@ type Config struct {
 	ListenAddress  string
 	OpsAddress     string
 	TokenPath      string
+	// VaultNamespace is the vault namespace that the sidecar logs in to and
+	// reads credentials from
+	VaultNamespace string
 }
 
 // Sidecar provides the basic functionality for retrieving credentials using the
@@ -56,6 +59,9 @@ func New(config *Config) (*Sidecar, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.VaultNamespace != "" {
+		vaultClient.SetNamespace(config.VaultNamespace)
+	}
 
 	backoff := &Backoff{
 		Jitter: true,